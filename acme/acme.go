@@ -0,0 +1,797 @@
+package acme
+
+// an ACME (RFC 8555) server in front of the local CA, so Traefik, Caddy and friends get certs
+// for cirrid's names with no more setup than trusting ca.crt. Challenges are checked against
+// cirrid itself: dns-01 in its own record store, and http-01 by fetching from the address cirrid
+// resolves the name to (usually the loopback alias).
+// Accounts are kept in Dir, orders only last as long as the daemon does (or until they expire).
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/dns"
+)
+
+// Config is the [acme] section from the cfg file
+type Config struct {
+	// the address to listen on, "magic" for the magic address
+	Listen string
+	Port   int
+	// the server's name (relative to Zone), published pointing at the listen address
+	Name string
+	Zone string
+	// where accounts are kept
+	Dir string
+	// the port http-01 challenges are fetched from, always 80 outside of testing
+	HTTPPort int
+}
+
+const DefaultPort = 14000
+const DefaultDir = "/etc/cirrid/acme"
+
+// how long orders (and their authorizations) have to be finished in, they're forgotten after that
+const orderLife = 24 * time.Hour
+
+// how many unexpired orders an account can have
+const maxOrders = 300
+
+// the /httpreq endpoints want this username, and the password in httpreqSecretFile
+const httpreqUser = "acme"
+const httpreqSecretFile = "httpreq.secret"
+
+var logger service.Logger
+var config Config
+var baseURL string
+var httpreqSecret string
+
+// guards accounts, orders, authzs and challenges
+var stateLock sync.Mutex
+var accounts = map[string]*account{}
+var orders = map[string]*order{}
+var authzs = map[string]*authz{}
+var challenges = map[string]*challenge{}
+
+var nonceLock sync.Mutex
+var nonces = map[string]time.Time{}
+
+type account struct {
+	ID      string
+	Key     jsonWebKey
+	Contact []string
+	Status  string
+	Orders  []string `json:"-"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	id          string
+	account     string
+	status      string
+	expires     time.Time
+	identifiers []identifier
+	authzs      []string
+	cert        []byte
+	err         *problem
+}
+
+type authz struct {
+	id         string
+	account    string
+	identifier identifier
+	wildcard   bool
+	status     string
+	expires    time.Time
+	challenges []string
+}
+
+type challenge struct {
+	id        string
+	authz     string
+	kind      string
+	token     string
+	status    string
+	validated time.Time
+	err       *problem
+}
+
+// Start publishes the server's name and runs its https listener in the background
+func Start(c Config, l service.Logger) error {
+	logger = l
+	if c.Port == 0 {
+		c.Port = DefaultPort
+	}
+	if c.HTTPPort == 0 {
+		c.HTTPPort = 80
+	}
+	if c.Dir == "" {
+		c.Dir = DefaultDir
+	}
+	config = c
+	// clients need to trust it before they can talk to us
+	if _, err := ca.Root(); err != nil {
+		return err
+	}
+	if err := loadAccounts(); err != nil {
+		return err
+	}
+	secret, err := loadHTTPReqSecret()
+	if err != nil {
+		return err
+	}
+	httpreqSecret = secret
+
+	address := c.Listen
+	if address == "" || address == "magic" {
+		address = dns.GetMagic().Address
+	}
+	if err := dns.Publish("acme", c.Zone, []dns.Host{{Name: c.Name, Address: address}}); err != nil {
+		return err
+	}
+	host := strings.Trim(c.Name, ".") + "." + strings.Trim(c.Zone, ".")
+	baseURL = "https://" + net.JoinHostPort(host, strconv.Itoa(c.Port))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", directory)
+	mux.HandleFunc("/new-nonce", newNonce)
+	mux.HandleFunc("/new-account", signed(false, newAccount))
+	mux.HandleFunc("/account/", signed(true, getAccount))
+	mux.HandleFunc("/new-order", signed(true, newOrder))
+	mux.HandleFunc("/order/", signed(true, getOrder))
+	mux.HandleFunc("/authz/", signed(true, getAuthz))
+	mux.HandleFunc("/chall/", signed(true, getChallenge))
+	mux.HandleFunc("/finalize/", signed(true, finalize))
+	mux.HandleFunc("/cert/", signed(true, getCert))
+	mux.HandleFunc("/revoke-cert", signed(false, revokeCert))
+	mux.HandleFunc("/httpreq/present", present)
+	mux.HandleFunc("/httpreq/cleanup", cleanup)
+
+	srv := &http.Server{
+		Addr:      net.JoinHostPort(address, strconv.Itoa(c.Port)),
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: ca.GetCertificate},
+	}
+	logger.Infof("ACME directory at %s/directory (listening on %s)\n", baseURL, srv.Addr)
+	go func() {
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			logger.Errorf("ACME listener stopped: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// DirectoryURL is where ACME clients should point, empty if the server isn't running
+func DirectoryURL() string {
+	if baseURL == "" {
+		return ""
+	}
+	return baseURL + "/directory"
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b64.EncodeToString(b)
+}
+
+// the accounts file is only read at startup, and written when an account changes
+func accountsFile() string {
+	return filepath.Join(config.Dir, "accounts.json")
+}
+
+// loadHTTPReqSecret reads the /httpreq password, making one the first time
+func loadHTTPReqSecret() (string, error) {
+	path := filepath.Join(config.Dir, httpreqSecretFile)
+	data, err := ioutil.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	secret := randomID()
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		return "", err
+	}
+	logger.Infof("ACME: the /httpreq password is in %s\n", path)
+	return secret, nil
+}
+
+func loadAccounts() error {
+	data, err := ioutil.ReadFile(accountsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	list := []*account{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %s", accountsFile(), err)
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	for _, a := range list {
+		accounts[a.ID] = a
+	}
+	return nil
+}
+
+// must be called with stateLock held
+func saveAccounts() {
+	list := []*account{}
+	for _, a := range accounts {
+		list = append(list, a)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(config.Dir, 0700); err == nil {
+			err = ioutil.WriteFile(accountsFile(), data, 0600)
+		}
+	}
+	if err != nil {
+		logger.Warningf("Can't save the ACME accounts: %s\n", err)
+	}
+}
+
+// problem is an RFC 7807 problem document, with an ACME error type
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func acmeProblem(kind string, status int, format string, a ...interface{}) *problem {
+	return &problem{Type: "urn:ietf:params:acme:error:" + kind, Detail: fmt.Sprintf(format, a...), Status: status}
+}
+
+func (p *problem) Error() string {
+	return p.Detail
+}
+
+// every reply has a fresh nonce for the client's next request
+func addNonce(w http.ResponseWriter) {
+	nonce := randomID()
+	nonceLock.Lock()
+	for n, issued := range nonces {
+		if time.Since(issued) > time.Hour {
+			delete(nonces, n)
+		}
+	}
+	nonces[nonce] = time.Now()
+	nonceLock.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", baseURL))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	addNonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, p *problem) {
+	addNonce(w)
+	if p.Status == 0 {
+		p.Status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func directory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   baseURL + "/new-nonce",
+		"newAccount": baseURL + "/new-account",
+		"newOrder":   baseURL + "/new-order",
+		"revokeCert": baseURL + "/revoke-cert",
+		"meta": map[string]interface{}{
+			"website": "https://github.com/onaci/cirrid",
+		},
+	})
+}
+
+func newNonce(w http.ResponseWriter, r *http.Request) {
+	addNonce(w)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// request is a verified JWS request
+type request struct {
+	payload []byte
+	// who signed it: an account (kid), or just a key (jwk)
+	account *account
+	key     jsonWebKey
+}
+
+// signed verifies the request's JWS before handing it on. Requests by a known account use kid,
+// the others (new accounts) a jwk
+func signed(byAccount bool, handler func(http.ResponseWriter, *http.Request, request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeProblem(w, acmeProblem("malformed", http.StatusMethodNotAllowed, "ACME requests are POSTs"))
+			return
+		}
+		req, p := verifyRequest(r, byAccount)
+		if p != nil {
+			writeProblem(w, p)
+			return
+		}
+		handler(w, r, req)
+	}
+}
+
+func verifyRequest(r *http.Request, byAccount bool) (request, *problem) {
+	var req request
+	var body jws
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+		return req, acmeProblem("malformed", 0, "can't read the JWS: %s", err)
+	}
+	protected, err := b64.DecodeString(body.Protected)
+	if err != nil {
+		return req, acmeProblem("malformed", 0, "bad protected header: %s", err)
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return req, acmeProblem("malformed", 0, "bad protected header: %s", err)
+	}
+
+	nonceLock.Lock()
+	_, fresh := nonces[header.Nonce]
+	delete(nonces, header.Nonce)
+	nonceLock.Unlock()
+	if !fresh {
+		return req, acmeProblem("badNonce", 0, "unknown or reused nonce")
+	}
+	if header.URL != baseURL+r.URL.Path {
+		return req, acmeProblem("unauthorized", http.StatusUnauthorized, "the JWS url %q doesn't match the request", header.URL)
+	}
+
+	switch {
+	case header.KID != "" && len(header.JWK) > 0:
+		return req, acmeProblem("malformed", 0, "the JWS has both a kid and a jwk")
+	case header.KID != "":
+		if !byAccount && !strings.HasSuffix(r.URL.Path, "/revoke-cert") {
+			return req, acmeProblem("malformed", 0, "new accounts are signed with a jwk")
+		}
+		stateLock.Lock()
+		a, ok := accounts[strings.TrimPrefix(header.KID, baseURL+"/account/")]
+		var status string
+		if ok {
+			status = a.Status
+			req.account = a
+			req.key = a.Key
+		}
+		stateLock.Unlock()
+		if !ok || !strings.HasPrefix(header.KID, baseURL+"/account/") {
+			return req, acmeProblem("accountDoesNotExist", http.StatusUnauthorized, "no account %s", header.KID)
+		}
+		if status != "valid" {
+			return req, acmeProblem("unauthorized", http.StatusUnauthorized, "account %s is %s", a.ID, status)
+		}
+	case len(header.JWK) > 0:
+		if byAccount {
+			return req, acmeProblem("malformed", 0, "requests by an account are signed with its kid")
+		}
+		if err := json.Unmarshal(header.JWK, &req.key); err != nil {
+			return req, acmeProblem("malformed", 0, "bad jwk: %s", err)
+		}
+	default:
+		return req, acmeProblem("malformed", 0, "the JWS has no kid or jwk")
+	}
+
+	pub, err := req.key.publicKey()
+	if err != nil {
+		return req, acmeProblem("badPublicKey", 0, "%s", err)
+	}
+	signature, err := b64.DecodeString(body.Signature)
+	if err != nil {
+		return req, acmeProblem("malformed", 0, "bad signature encoding: %s", err)
+	}
+	if err := verify(header.Alg, pub, body.Protected+"."+body.Payload, signature); err != nil {
+		return req, acmeProblem("badSignatureAlgorithm", 0, "%s", err)
+	}
+	if req.payload, err = b64.DecodeString(body.Payload); err != nil {
+		return req, acmeProblem("malformed", 0, "bad payload encoding: %s", err)
+	}
+	return req, nil
+}
+
+// postAsGet is true for a POST-as-GET, which has an empty payload
+func (req request) postAsGet() bool {
+	return len(req.payload) == 0
+}
+
+// the id at the end of a /kind/ID path
+func pathID(r *http.Request, kind string) string {
+	return strings.TrimPrefix(r.URL.Path, "/"+kind+"/")
+}
+
+func accountURL(id string) string { return baseURL + "/account/" + id }
+func orderURL(id string) string   { return baseURL + "/order/" + id }
+func authzURL(id string) string   { return baseURL + "/authz/" + id }
+
+// must be called with stateLock held
+func accountJSON(a *account) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  a.Status,
+		"contact": a.Contact,
+		"orders":  accountURL(a.ID) + "/orders",
+	}
+}
+
+func newAccount(w http.ResponseWriter, r *http.Request, req request) {
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, acmeProblem("malformed", 0, "bad new-account request: %s", err))
+		return
+	}
+	thumbprint := req.key.thumbprint()
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	for _, a := range accounts {
+		if a.Key.thumbprint() == thumbprint {
+			w.Header().Set("Location", accountURL(a.ID))
+			writeJSON(w, http.StatusOK, accountJSON(a))
+			return
+		}
+	}
+	if payload.OnlyReturnExisting {
+		writeProblem(w, acmeProblem("accountDoesNotExist", 0, "no account for that key"))
+		return
+	}
+	a := &account{ID: randomID(), Key: req.key, Contact: payload.Contact, Status: "valid"}
+	accounts[a.ID] = a
+	saveAccounts()
+	logger.Infof("ACME: new account %s %s\n", a.ID, strings.Join(a.Contact, ", "))
+	w.Header().Set("Location", accountURL(a.ID))
+	writeJSON(w, http.StatusCreated, accountJSON(a))
+}
+
+// /account/ID (updates, or deactivation) and /account/ID/orders
+func getAccount(w http.ResponseWriter, r *http.Request, req request) {
+	id := pathID(r, "account")
+	listOrders := strings.HasSuffix(id, "/orders")
+	id = strings.TrimSuffix(id, "/orders")
+	if id != req.account.ID {
+		writeProblem(w, acmeProblem("unauthorized", http.StatusForbidden, "that's not your account"))
+		return
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	a := req.account
+	if listOrders {
+		urls := []string{}
+		for _, o := range a.Orders {
+			urls = append(urls, orderURL(o))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"orders": urls})
+		return
+	}
+	if !req.postAsGet() {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, acmeProblem("malformed", 0, "bad account update: %s", err))
+			return
+		}
+		if payload.Contact != nil {
+			a.Contact = payload.Contact
+		}
+		if payload.Status == "deactivated" {
+			a.Status = "deactivated"
+		}
+		saveAccounts()
+	}
+	writeJSON(w, http.StatusOK, accountJSON(a))
+}
+
+func newOrder(w http.ResponseWriter, r *http.Request, req request) {
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		writeProblem(w, acmeProblem("malformed", 0, "a new order needs identifiers"))
+		return
+	}
+	for i, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			writeProblem(w, acmeProblem("unsupportedIdentifier", 0, "only dns identifiers are supported, not %q", id.Type))
+			return
+		}
+		payload.Identifiers[i].Value = strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if err := ca.Allowed(payload.Identifiers[i].Value); err != nil {
+			writeProblem(w, acmeProblem("rejectedIdentifier", 0, "%s", err))
+			return
+		}
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	purgeExpired()
+	if len(req.account.Orders) >= maxOrders {
+		writeProblem(w, acmeProblem("rateLimited", http.StatusTooManyRequests, "account %s already has %d orders, finish them or wait for them to expire", req.account.ID, maxOrders))
+		return
+	}
+	o := &order{
+		id:          randomID(),
+		account:     req.account.ID,
+		status:      "pending",
+		expires:     time.Now().Add(orderLife),
+		identifiers: payload.Identifiers,
+	}
+	for _, id := range payload.Identifiers {
+		az := &authz{
+			id:         randomID(),
+			account:    req.account.ID,
+			identifier: identifier{Type: "dns", Value: strings.TrimPrefix(id.Value, "*.")},
+			wildcard:   strings.HasPrefix(id.Value, "*."),
+			status:     "pending",
+			expires:    o.expires,
+		}
+		kinds := []string{"http-01", "dns-01"}
+		if az.wildcard {
+			// only the dns can show you control all the names below
+			kinds = []string{"dns-01"}
+		}
+		for _, kind := range kinds {
+			ch := &challenge{id: randomID(), authz: az.id, kind: kind, token: randomID(), status: "pending"}
+			challenges[ch.id] = ch
+			az.challenges = append(az.challenges, ch.id)
+		}
+		authzs[az.id] = az
+		o.authzs = append(o.authzs, az.id)
+	}
+	orders[o.id] = o
+	req.account.Orders = append(req.account.Orders, o.id)
+	w.Header().Set("Location", orderURL(o.id))
+	writeJSON(w, http.StatusCreated, orderJSON(o))
+}
+
+// purgeExpired forgets the orders past their expiry, with their authorizations and challenges,
+// must be called with stateLock held
+func purgeExpired() {
+	now := time.Now()
+	for id, o := range orders {
+		if now.Before(o.expires) {
+			continue
+		}
+		for _, azID := range o.authzs {
+			if az, ok := authzs[azID]; ok {
+				for _, chID := range az.challenges {
+					delete(challenges, chID)
+				}
+				delete(authzs, azID)
+			}
+		}
+		delete(orders, id)
+		if a, ok := accounts[o.account]; ok {
+			kept := []string{}
+			for _, oid := range a.Orders {
+				if oid != id {
+					kept = append(kept, oid)
+				}
+			}
+			a.Orders = kept
+		}
+	}
+}
+
+// must be called with stateLock held
+func orderJSON(o *order) map[string]interface{} {
+	updateOrder(o)
+	urls := []string{}
+	for _, id := range o.authzs {
+		urls = append(urls, authzURL(id))
+	}
+	v := map[string]interface{}{
+		"status":         o.status,
+		"expires":        o.expires.UTC().Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": urls,
+		"finalize":       baseURL + "/finalize/" + o.id,
+	}
+	if o.cert != nil {
+		v["certificate"] = baseURL + "/cert/" + o.id
+	}
+	if o.err != nil {
+		v["error"] = o.err
+	}
+	return v
+}
+
+// updateOrder moves the order along once its authorizations are done (or one fails)
+// must be called with stateLock held
+func updateOrder(o *order) {
+	if o.status != "pending" {
+		return
+	}
+	if time.Now().After(o.expires) {
+		o.status = "invalid"
+		return
+	}
+	ready := true
+	for _, id := range o.authzs {
+		switch authzs[id].status {
+		case "invalid":
+			o.status = "invalid"
+			return
+		case "valid":
+		default:
+			ready = false
+		}
+	}
+	if ready {
+		o.status = "ready"
+	}
+}
+
+// findOrder gets the account's order, or writes the problem
+// must be called with stateLock held
+func findOrder(w http.ResponseWriter, id string, req request) *order {
+	o, ok := orders[id]
+	if !ok {
+		writeProblem(w, acmeProblem("malformed", http.StatusNotFound, "no order %s", id))
+		return nil
+	}
+	if o.account != req.account.ID {
+		writeProblem(w, acmeProblem("unauthorized", http.StatusForbidden, "that's not your order"))
+		return nil
+	}
+	return o
+}
+
+func getOrder(w http.ResponseWriter, r *http.Request, req request) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if o := findOrder(w, pathID(r, "order"), req); o != nil {
+		writeJSON(w, http.StatusOK, orderJSON(o))
+	}
+}
+
+// must be called with stateLock held
+func authzJSON(az *authz) map[string]interface{} {
+	list := []interface{}{}
+	for _, id := range az.challenges {
+		list = append(list, challengeJSON(challenges[id]))
+	}
+	v := map[string]interface{}{
+		"status":     az.status,
+		"expires":    az.expires.UTC().Format(time.RFC3339),
+		"identifier": az.identifier,
+		"challenges": list,
+	}
+	if az.wildcard {
+		v["wildcard"] = true
+	}
+	return v
+}
+
+// must be called with stateLock held
+func challengeJSON(ch *challenge) map[string]interface{} {
+	v := map[string]interface{}{
+		"type":   ch.kind,
+		"url":    baseURL + "/chall/" + ch.id,
+		"token":  ch.token,
+		"status": ch.status,
+	}
+	if !ch.validated.IsZero() {
+		v["validated"] = ch.validated.UTC().Format(time.RFC3339)
+	}
+	if ch.err != nil {
+		v["error"] = ch.err
+	}
+	return v
+}
+
+func getAuthz(w http.ResponseWriter, r *http.Request, req request) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	az, ok := authzs[pathID(r, "authz")]
+	if !ok || az.account != req.account.ID {
+		writeProblem(w, acmeProblem("malformed", http.StatusNotFound, "no authorization %s", pathID(r, "authz")))
+		return
+	}
+	if !req.postAsGet() {
+		// the only change a client can make is deactivating it
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if json.Unmarshal(req.payload, &payload) == nil && payload.Status == "deactivated" {
+			az.status = "deactivated"
+		}
+	}
+	writeJSON(w, http.StatusOK, authzJSON(az))
+}
+
+// a POST of {} asks for the challenge to be checked, a POST-as-GET just how it went
+func getChallenge(w http.ResponseWriter, r *http.Request, req request) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	ch, ok := challenges[pathID(r, "chall")]
+	if !ok || authzs[ch.authz].account != req.account.ID {
+		writeProblem(w, acmeProblem("malformed", http.StatusNotFound, "no challenge %s", pathID(r, "chall")))
+		return
+	}
+	az := authzs[ch.authz]
+	if !req.postAsGet() && ch.status == "pending" && az.status == "pending" {
+		ch.status = "processing"
+		go validate(ch.id, az.identifier.Value, ch.kind, ch.token, req.account.Key.thumbprint())
+	}
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"up\"", authzURL(az.id)))
+	if ch.status == "processing" {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, http.StatusOK, challengeJSON(ch))
+}
+
+// validated records how a challenge went, and so its authorization
+func validated(id string, err error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	ch, ok := challenges[id]
+	if !ok {
+		// its order expired (and was forgotten) while it was being checked
+		return
+	}
+	az := authzs[ch.authz]
+	if err != nil {
+		logger.Warningf("ACME: %s challenge for %s failed: %s\n", ch.kind, az.identifier.Value, err)
+		ch.status = "invalid"
+		ch.err = acmeProblem(challengeProblem(ch.kind), 0, "%s", err)
+		az.status = "invalid"
+		return
+	}
+	logger.Infof("ACME: %s challenge for %s passed\n", ch.kind, az.identifier.Value)
+	ch.status = "valid"
+	ch.validated = time.Now()
+	az.status = "valid"
+}
+
+func challengeProblem(kind string) string {
+	if kind == "dns-01" {
+		return "dns"
+	}
+	return "connection"
+}
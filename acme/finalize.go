@@ -0,0 +1,119 @@
+package acme
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/onaci/cirrid/ca"
+)
+
+// finalize has the local CA sign the order's CSR, once all its authorizations are valid
+func finalize(w http.ResponseWriter, r *http.Request, req request) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, acmeProblem("malformed", 0, "bad finalize request: %s", err))
+		return
+	}
+	der, err := b64.DecodeString(payload.CSR)
+	if err != nil {
+		writeProblem(w, acmeProblem("badCSR", 0, "bad CSR encoding: %s", err))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeProblem(w, acmeProblem("badCSR", 0, "%s", err))
+		return
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	o := findOrder(w, pathID(r, "finalize"), req)
+	if o == nil {
+		return
+	}
+	updateOrder(o)
+	if o.status != "ready" {
+		writeProblem(w, acmeProblem("orderNotReady", http.StatusForbidden, "the order is %s", o.status))
+		return
+	}
+	names, ok := csrNames(csr, o.identifiers)
+	if !ok {
+		writeProblem(w, acmeProblem("badCSR", 0, "the CSR's names aren't the order's"))
+		return
+	}
+	o.status = "processing"
+	cert, err := ca.Sign(names, csr.PublicKey)
+	if err == nil {
+		var root *x509.Certificate
+		if root, err = ca.Root(); err == nil {
+			o.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})...)
+		}
+	}
+	if err != nil {
+		o.status = "invalid"
+		o.err = acmeProblem("serverInternal", http.StatusInternalServerError, "%s", err)
+		writeProblem(w, o.err)
+		return
+	}
+	o.status = "valid"
+	logger.Infof("ACME: issued a cert for %s\n", strings.Join(names, ", "))
+	w.Header().Set("Location", orderURL(o.id))
+	writeJSON(w, http.StatusOK, orderJSON(o))
+}
+
+// csrNames are the CSR's names, if they're the same as the order's
+func csrNames(csr *x509.CertificateRequest, identifiers []identifier) ([]string, bool) {
+	set := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		set[strings.ToLower(name)] = true
+	}
+	if csr.Subject.CommonName != "" {
+		set[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 || len(set) != len(identifiers) {
+		return nil, false
+	}
+	names := []string{}
+	for _, id := range identifiers {
+		if !set[id.Value] {
+			return nil, false
+		}
+		names = append(names, id.Value)
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func getCert(w http.ResponseWriter, r *http.Request, req request) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	o := findOrder(w, pathID(r, "cert"), req)
+	if o == nil {
+		return
+	}
+	if o.cert == nil {
+		writeProblem(w, acmeProblem("malformed", http.StatusNotFound, "the order has no cert yet"))
+		return
+	}
+	addNonce(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(o.cert)
+}
+
+// the local CA's certs are short-lived, and there's no CRL or OCSP to publish a revocation in,
+// so revoking is accepted but changes nothing
+func revokeCert(w http.ResponseWriter, r *http.Request, req request) {
+	logger.Infof("ACME: ignoring a revocation, the cert will expire soon enough\n")
+	addNonce(w)
+	w.WriteHeader(http.StatusOK)
+}
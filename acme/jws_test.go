@@ -0,0 +1,259 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kardianos/service"
+)
+
+const testBaseURL = "https://acme.ona.im:14000"
+
+// testKey signs JWSs the way an ACME client would
+type testKey struct {
+	alg  string
+	jwk  jsonWebKey
+	sign func(signed []byte) []byte
+}
+
+func es256Key(t *testing.T) testKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{
+		alg: "ES256",
+		jwk: jsonWebKey{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(pad(key.X, 32)), Y: b64.EncodeToString(pad(key.Y, 32))},
+		sign: func(signed []byte) []byte {
+			sum := sha256.Sum256(signed)
+			r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append(pad(r, 32), pad(s, 32)...)
+		},
+	}
+}
+
+func rs256Key(t *testing.T) testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{
+		alg: "RS256",
+		jwk: jsonWebKey{Kty: "RSA", N: b64.EncodeToString(key.N.Bytes()), E: b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())},
+		sign: func(signed []byte) []byte {
+			sum := sha256.Sum256(signed)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}
+}
+
+func eddsaKey(t *testing.T) testKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{
+		alg:  "EdDSA",
+		jwk:  jsonWebKey{Kty: "OKP", Crv: "Ed25519", X: b64.EncodeToString(pub)},
+		sign: func(signed []byte) []byte { return ed25519.Sign(priv, signed) },
+	}
+}
+
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// useACME resets the accounts and nonces, for a server at testBaseURL
+func useACME(t *testing.T) {
+	logger = service.ConsoleLogger
+	oldBaseURL := baseURL
+	baseURL = testBaseURL
+	stateLock.Lock()
+	accounts = map[string]*account{}
+	stateLock.Unlock()
+	t.Cleanup(func() { baseURL = oldBaseURL })
+}
+
+func freshNonce() string {
+	w := httptest.NewRecorder()
+	addNonce(w)
+	return w.Header().Get("Replay-Nonce")
+}
+
+// jwsRequest is what the client sends, before (and after) signing
+type jwsRequest struct {
+	key     testKey
+	header  jwsHeader
+	payload string
+	// mangles the signature after signing
+	tamper func([]byte) []byte
+}
+
+// newJWS makes a request signed with key's jwk, to path, with a fresh nonce
+func newJWS(key testKey, path, payload string) *jwsRequest {
+	jwk, _ := json.Marshal(key.jwk)
+	return &jwsRequest{
+		key:     key,
+		header:  jwsHeader{Alg: key.alg, Nonce: freshNonce(), URL: testBaseURL + path, JWK: jwk},
+		payload: payload,
+	}
+}
+
+// byKID switches the request to being signed by account id
+func (j *jwsRequest) byKID(kid string) *jwsRequest {
+	j.header.JWK = nil
+	j.header.KID = kid
+	return j
+}
+
+func (j *jwsRequest) send(path string, byAccount bool) (request, *problem) {
+	// clients leave out whichever of jwk and kid they aren't using
+	protected, _ := json.Marshal(struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		JWK   json.RawMessage `json:"jwk,omitempty"`
+		KID   string          `json:"kid,omitempty"`
+	}{j.header.Alg, j.header.Nonce, j.header.URL, j.header.JWK, j.header.KID})
+	body := jws{Protected: b64.EncodeToString(protected), Payload: b64.EncodeToString([]byte(j.payload))}
+	signature := j.key.sign([]byte(body.Protected + "." + body.Payload))
+	if j.tamper != nil {
+		signature = j.tamper(signature)
+	}
+	body.Signature = b64.EncodeToString(signature)
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(data)))
+	return verifyRequest(r, byAccount)
+}
+
+func TestVerifyRequestKeyTypes(t *testing.T) {
+	useACME(t)
+	for _, key := range []testKey{es256Key(t), rs256Key(t), eddsaKey(t)} {
+		req, p := newJWS(key, "/new-account", `{"termsOfServiceAgreed": true}`).send("/new-account", false)
+		if p != nil {
+			t.Errorf("%s: %s", key.alg, p)
+			continue
+		}
+		if req.key.thumbprint() != key.jwk.thumbprint() || !strings.Contains(string(req.payload), "termsOfServiceAgreed") {
+			t.Errorf("%s: got %+v", key.alg, req)
+		}
+	}
+}
+
+func TestVerifyRequestRejects(t *testing.T) {
+	useACME(t)
+	es256, rs256, eddsa := es256Key(t), rs256Key(t), eddsaKey(t)
+	stateLock.Lock()
+	accounts["acct1"] = &account{ID: "acct1", Key: es256.jwk, Status: "valid"}
+	accounts["gone"] = &account{ID: "gone", Key: es256.jwk, Status: "deactivated"}
+	stateLock.Unlock()
+
+	reused := newJWS(es256, "/new-account", "{}")
+	if _, p := reused.send("/new-account", false); p != nil {
+		t.Fatalf("first use of the nonce: %s", p)
+	}
+
+	tests := []struct {
+		name      string
+		req       *jwsRequest
+		path      string
+		byAccount bool
+		problem   string
+	}{
+		{name: "alg doesn't match an EC key", req: func() *jwsRequest {
+			j := newJWS(es256, "/new-account", "{}")
+			j.header.Alg = "RS256"
+			return j
+		}(), path: "/new-account", problem: "badSignatureAlgorithm"},
+		{name: "ES384 with a P-256 key", req: func() *jwsRequest {
+			j := newJWS(es256, "/new-account", "{}")
+			j.header.Alg = "ES384"
+			return j
+		}(), path: "/new-account", problem: "badSignatureAlgorithm"},
+		{name: "alg doesn't match an RSA key", req: func() *jwsRequest {
+			j := newJWS(rs256, "/new-account", "{}")
+			j.header.Alg = "PS256"
+			return j
+		}(), path: "/new-account", problem: "badSignatureAlgorithm"},
+		{name: "alg doesn't match an Ed25519 key", req: func() *jwsRequest {
+			j := newJWS(eddsa, "/new-account", "{}")
+			j.header.Alg = "ES256"
+			return j
+		}(), path: "/new-account", problem: "badSignatureAlgorithm"},
+		{name: "truncated ECDSA signature", req: func() *jwsRequest {
+			j := newJWS(es256, "/new-account", "{}")
+			j.tamper = func(sig []byte) []byte { return sig[:len(sig)-1] }
+			return j
+		}(), path: "/new-account", problem: "badSignatureAlgorithm"},
+		{name: "bad RSA signature", req: func() *jwsRequest {
+			j := newJWS(rs256, "/new-account", "{}")
+			j.tamper = func(sig []byte) []byte { sig[0] ^= 1; return sig }
+			return j
+		}(), path: "/new-account", problem: "badSignatureAlgorithm"},
+		{name: "reused nonce", req: reused, path: "/new-account", problem: "badNonce"},
+		{name: "made up nonce", req: func() *jwsRequest {
+			j := newJWS(es256, "/new-account", "{}")
+			j.header.Nonce = "not-one-of-ours"
+			return j
+		}(), path: "/new-account", problem: "badNonce"},
+		{name: "wrong url", req: newJWS(es256, "/new-order", "{}"), path: "/new-account", problem: "unauthorized"},
+		{name: "foreign kid", req: newJWS(es256, "/new-order", "{}").byKID("https://acme.example.org/account/acct1"),
+			path: "/new-order", byAccount: true, problem: "accountDoesNotExist"},
+		{name: "unknown kid", req: newJWS(es256, "/new-order", "{}").byKID(testBaseURL + "/account/nobody"),
+			path: "/new-order", byAccount: true, problem: "accountDoesNotExist"},
+		{name: "deactivated account", req: newJWS(es256, "/new-order", "{}").byKID(testBaseURL + "/account/gone"),
+			path: "/new-order", byAccount: true, problem: "unauthorized"},
+		{name: "kid signed by another key", req: newJWS(rs256, "/new-order", "{}").byKID(testBaseURL + "/account/acct1"),
+			path: "/new-order", byAccount: true, problem: "badSignatureAlgorithm"},
+		{name: "account request with a jwk", req: newJWS(es256, "/new-order", "{}"),
+			path: "/new-order", byAccount: true, problem: "malformed"},
+		{name: "new account with a kid", req: newJWS(es256, "/new-account", "{}").byKID(testBaseURL + "/account/acct1"),
+			path: "/new-account", problem: "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, p := tt.req.send(tt.path, tt.byAccount)
+			if p == nil {
+				t.Fatal("accepted")
+			}
+			if want := "urn:ietf:params:acme:error:" + tt.problem; p.Type != want {
+				t.Errorf("got %s (%s), want %s", p.Type, p.Detail, want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestByAccount(t *testing.T) {
+	useACME(t)
+	key := eddsaKey(t)
+	stateLock.Lock()
+	accounts["acct1"] = &account{ID: "acct1", Key: key.jwk, Status: "valid"}
+	stateLock.Unlock()
+
+	req, p := newJWS(key, "/new-order", "").byKID(testBaseURL+"/account/acct1").send("/new-order", true)
+	if p != nil {
+		t.Fatal(p)
+	}
+	if req.account == nil || req.account.ID != "acct1" || !req.postAsGet() {
+		t.Errorf("got %+v", req)
+	}
+}
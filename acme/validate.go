@@ -0,0 +1,183 @@
+package acme
+
+// challenges are checked against cirrid itself, and clients that can't serve http-01 (or want
+// wildcards) add their dns-01 TXT records through the /httpreq endpoints, which speak lego's
+// httpreq DNS provider protocol (so eg Traefik can use HTTPREQ_ENDPOINT=https://acme.ZONE:14000/httpreq).
+// Anyone who can add those records passes dns-01, so they need basic auth: httpreqUser, and the
+// password in Dir/httpreq.secret (HTTPREQ_USERNAME and HTTPREQ_PASSWORD for lego)
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/dns"
+)
+
+// clients often ask for the challenge to be checked a moment before it's ready
+const validateAttempts = 3
+const validateRetry = 2 * time.Second
+
+func validate(id, name, kind, token, thumbprint string) {
+	keyAuth := token + "." + thumbprint
+	var err error
+	for attempt := 0; attempt < validateAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(validateRetry)
+		}
+		if kind == "dns-01" {
+			err = checkDNS(name, keyAuth)
+		} else {
+			err = checkHTTP(name, token, keyAuth)
+		}
+		if err == nil {
+			break
+		}
+	}
+	validated(id, err)
+}
+
+// checkDNS looks for the key authorization's digest in our own _acme-challenge TXT records
+func checkDNS(name, keyAuth string) error {
+	sum := sha256.Sum256([]byte(keyAuth))
+	want := b64.EncodeToString(sum[:])
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn("_acme-challenge."+name), mdns.TypeTXT)
+	if r := dns.Exchange(m); r != nil {
+		for _, rr := range r.Answer {
+			if txt, ok := rr.(*mdns.TXT); ok && strings.Join(txt.Txt, "") == want {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no TXT record at _acme-challenge.%s with the key authorization's digest", name)
+}
+
+// lookupA is the address cirrid answers with for name
+func lookupA(name string) (string, error) {
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn(name), mdns.TypeA)
+	if r := dns.Exchange(m); r != nil {
+		for _, rr := range r.Answer {
+			if a, ok := rr.(*mdns.A); ok {
+				return a.A.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cirrid has no address for %s", name)
+}
+
+// checkHTTP fetches the key authorization from the address cirrid has for the name,
+// which is usually the loopback alias (or the magic address), where the client's listening
+func checkHTTP(name, token, keyAuth string) error {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				ip, err := lookupA(host)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			},
+			// redirects to https are allowed, but its cert isn't what's being checked (RFC 8555 8.3)
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", net.JoinHostPort(name, strconv.Itoa(config.HTTPPort)), token)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("%s didn't answer with the key authorization", url)
+	}
+	return nil
+}
+
+// httpreqMessage is what lego's httpreq provider sends
+type httpreqMessage struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// readHTTPReq only lets through requests with the httpreq password, for _acme-challenge names
+// of names the local CA would issue certs for
+func readHTTPReq(w http.ResponseWriter, r *http.Request) (httpreqMessage, bool) {
+	var msg httpreqMessage
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST the fqdn and value", http.StatusMethodNotAllowed)
+		return msg, false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(httpreqUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(httpreqSecret)) != 1 {
+		logger.Warningf("ACME: refused an httpreq request from %s without the password\n", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="cirrid httpreq"`)
+		http.Error(w, "the httpreq endpoints need the username and password", http.StatusUnauthorized)
+		return msg, false
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return msg, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(msg.FQDN, "."))
+	if !strings.HasPrefix(name, "_acme-challenge.") || msg.Value == "" {
+		http.Error(w, "only _acme-challenge TXT records can be added", http.StatusBadRequest)
+		return msg, false
+	}
+	if err := ca.Allowed(strings.TrimPrefix(name, "_acme-challenge.")); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return msg, false
+	}
+	msg.FQDN = name
+	return msg, true
+}
+
+func present(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readHTTPReq(w, r)
+	if !ok {
+		return
+	}
+	if err := dns.AddTXT(msg.FQDN, msg.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Infof("ACME: added a TXT record at %s\n", msg.FQDN)
+	w.WriteHeader(http.StatusOK)
+}
+
+func cleanup(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readHTTPReq(w, r)
+	if !ok {
+		return
+	}
+	dns.RemoveTXT(msg.FQDN, msg.Value)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,60 @@
+package acme
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/dns"
+)
+
+func TestHTTPReq(t *testing.T) {
+	logger = service.ConsoleLogger
+	dns.SetLogger(service.ConsoleLogger)
+	dns.AddZone(dns.Zone{Name: "ona.im"})
+	if err := dns.AddRecord("ona.im", "app", "A 192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	oldSecret := httpreqSecret
+	httpreqSecret = "s3cret"
+	defer func() { httpreqSecret = oldSecret }()
+
+	tests := []struct {
+		name           string
+		user, password string
+		fqdn           string
+		status         int
+	}{
+		{name: "no password", fqdn: "_acme-challenge.app.ona.im.", status: http.StatusUnauthorized},
+		{name: "wrong password", user: "acme", password: "guess", fqdn: "_acme-challenge.app.ona.im.", status: http.StatusUnauthorized},
+		{name: "wrong user", user: "admin", password: "s3cret", fqdn: "_acme-challenge.app.ona.im.", status: http.StatusUnauthorized},
+		{name: "not a challenge name", user: "acme", password: "s3cret", fqdn: "app.ona.im.", status: http.StatusBadRequest},
+		{name: "not one of our names", user: "acme", password: "s3cret", fqdn: "_acme-challenge.example.org.", status: http.StatusForbidden},
+		{name: "not a name we have", user: "acme", password: "s3cret", fqdn: "_acme-challenge.nope.ona.im.", status: http.StatusForbidden},
+		{name: "ok", user: "acme", password: "s3cret", fqdn: "_acme-challenge.app.ona.im.", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/httpreq/present", strings.NewReader(`{"fqdn": "`+tt.fqdn+`", "value": "token"}`))
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			present(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+		})
+	}
+
+	result, err := dns.Query("_acme-challenge.app.ona.im", "TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Answer) != 1 || !strings.Contains(result.Answer[0], `"token"`) {
+		t.Errorf("TXT records %q", result.Answer)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/control"
+)
+
+// certRequest is the body of a POST to /ca/cert
+type certRequest struct {
+	Names []string
+}
+
+func registerCAHandlers() {
+	control.HandleFunc("/ca", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, ca.GetInfo())
+	})
+	// issue a cert for names cirrid answers for, writing it to the certs dir
+	control.HandlePrivileged("/ca/cert", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST the names", http.StatusMethodNotAllowed)
+			return
+		}
+		var req certRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert, err := ca.WriteCert(req.Names)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Infof("Issued a cert for %s: %s\n", strings.Join(cert.Names, ", "), cert.CertFile)
+		control.WriteJSON(w, cert)
+	})
+}
+
+// `cirrid ca [info]|trust|untrust|cert` - the local CA
+func caCmd(args []string) error {
+	if len(args) == 0 {
+		args = []string{"info"}
+	}
+	switch args[0] {
+	case "info":
+		return caInfo(args[1:])
+	case "trust":
+		requirePrivileges("ca trust")
+		return caTrust(args[1:])
+	case "untrust":
+		requirePrivileges("ca untrust")
+		return caUntrust(args[1:])
+	case "cert":
+		requirePrivileges("ca cert")
+		return caCert(args[1:])
+	}
+	return fmt.Errorf("usage: cirrid ca info|trust|untrust|cert")
+}
+
+func caInfo(args []string) error {
+	flags := flag.NewFlagSet("ca info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output the raw CA info json")
+	flags.Parse(args)
+
+	var info ca.Info
+	if err := control.Get("/ca", &info); err != nil {
+		return err
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	if info.Subject == "" {
+		fmt.Printf("no local CA yet, it's made in %s the first time a cert is asked for (or by 'sudo cirrid ca trust')\n", info.Dir)
+		return nil
+	}
+	trusted := "trusted"
+	if !info.Trusted {
+		trusted = "not trusted, use 'sudo cirrid ca trust'"
+	}
+	fmt.Printf("%s (%s)\n  %s, expires %s\n  SHA-256 %s\n", info.Subject, trusted, info.RootFile, info.NotAfter.Format("2006-01-02"), info.Fingerprint)
+	fmt.Printf("certs in %s:\n", info.CertsDir)
+	for _, c := range info.Certs {
+		fmt.Printf("  %s: %s (expires %s)\n", strings.Join(c.Names, ", "), c.CertFile, c.NotAfter.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// the trust store is changed here rather than by the daemon, the CA is made if it needs to be
+func caTrust(args []string) error {
+	flags := flag.NewFlagSet("ca trust", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	ca.Configure(readCA(cfg), logger)
+	root, err := ca.Root()
+	if err != nil {
+		return err
+	}
+	if err := ca.Trust(); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now trusted by the system (SHA-256 %s)\n", root.Subject.CommonName, ca.Fingerprint(root))
+	fmt.Printf("browsers with their own trust store (like Firefox) need %s imported by hand\n", ca.RootFile())
+	return nil
+}
+
+func caUntrust(args []string) error {
+	flags := flag.NewFlagSet("ca untrust", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	ca.Configure(readCA(cfg), logger)
+	if !ca.Exists() {
+		return fmt.Errorf("there's no local CA in %s", readCA(cfg).Dir)
+	}
+	if err := ca.Untrust(); err != nil {
+		return err
+	}
+	fmt.Printf("the local CA is no longer trusted by the system\n")
+	return nil
+}
+
+// issuing is left to the daemon, it knows which names cirrid answers for
+func caCert(args []string) error {
+	flags := flag.NewFlagSet("ca cert", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: cirrid ca cert NAME [NAME...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("which names?")
+	}
+
+	var cert ca.Cert
+	if err := control.Post("/ca/cert", certRequest{Names: flags.Args()}, &cert); err != nil {
+		return err
+	}
+	fmt.Printf("cert for %s (expires %s, renewed by the daemon):\n  %s\n  %s\n", strings.Join(cert.Names, ", "), cert.NotAfter.Format("2006-01-02 15:04"), cert.CertFile, cert.KeyFile)
+	return nil
+}
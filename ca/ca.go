@@ -0,0 +1,536 @@
+package ca
+
+// a local certificate authority, like mkcert but driven by cirrid's zones: the root is made
+// the first time it's needed and kept in Dir, and leaf certs are only issued for names cirrid
+// answers for. They're short-lived - cirrid renews the ones it wrote to CertsDir, so containers
+// can mount that dir and always find a current cert (and ca.crt, to trust it).
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/dns"
+)
+
+// Config is the [ca] section from the cfg file
+type Config struct {
+	// where the root cert and key are kept
+	Dir string
+	// where issued certs are written, for containers to mount
+	CertsDir string
+	// how long leaf certs are valid for
+	Lifetime time.Duration
+	// a new root is name constrained to these, so it can't vouch for anything else
+	Zones []string
+}
+
+const DefaultDir = "/etc/cirrid/ca"
+const DefaultCertsDir = "/etc/cirrid/certs"
+const DefaultLifetime = 7 * 24 * time.Hour
+
+// how often the certs in CertsDir are checked, they're renewed when a third of their life is left
+const renewCheck = time.Hour
+
+// how many certs GetCertificate keeps, clients can ask for any name under a wildcard
+const maxIssued = 1000
+
+const rootCertFile = "rootCA.pem"
+const rootKeyFile = "rootCA-key.pem"
+
+// Info is what `cirrid ca` shows
+type Info struct {
+	Dir         string
+	RootFile    string
+	Subject     string
+	Fingerprint string
+	NotAfter    time.Time
+	Trusted     bool
+	CertsDir    string
+	Certs       []Cert
+}
+
+// Cert is a leaf cert written to CertsDir
+type Cert struct {
+	Names    []string
+	CertFile string
+	KeyFile  string
+	NotAfter time.Time
+}
+
+var logger service.Logger
+var config = Config{Dir: DefaultDir, CertsDir: DefaultCertsDir, Lifetime: DefaultLifetime}
+
+// guards root, rootKey and issued
+var caLock sync.Mutex
+var root *x509.Certificate
+var rootKey crypto.Signer
+
+// name -> cert for the proxy's (and others') tls.Configs
+var issued = map[string]*tls.Certificate{}
+
+// Configure sets where the CA lives, and how long its certs last
+func Configure(c Config, l service.Logger) {
+	caLock.Lock()
+	defer caLock.Unlock()
+	logger = l
+	if c.Dir == "" {
+		c.Dir = DefaultDir
+	}
+	if c.CertsDir == "" {
+		c.CertsDir = DefaultCertsDir
+	}
+	if c.Lifetime <= 0 {
+		c.Lifetime = DefaultLifetime
+	}
+	if c.Dir != config.Dir {
+		root, rootKey = nil, nil
+		issued = map[string]*tls.Certificate{}
+	}
+	config = c
+}
+
+// RootFile is the root cert's PEM file
+func RootFile() string {
+	caLock.Lock()
+	defer caLock.Unlock()
+	return filepath.Join(config.Dir, rootCertFile)
+}
+
+// Exists is true if the root has been made
+func Exists() bool {
+	_, err := os.Stat(RootFile())
+	return err == nil
+}
+
+// Root loads the root cert, making it (and its key) first if there isn't one yet
+func Root() (*x509.Certificate, error) {
+	caLock.Lock()
+	defer caLock.Unlock()
+	if err := loadRoot(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// must be called with caLock held
+func loadRoot() error {
+	if root != nil {
+		return nil
+	}
+	certFile := filepath.Join(config.Dir, rootCertFile)
+	keyFile := filepath.Join(config.Dir, rootKeyFile)
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if err := createRoot(certFile, keyFile); err != nil {
+			return fmt.Errorf("can't create the local CA: %s", err)
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load the local CA: %s", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("can't load the local CA: %s", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("can't sign with the local CA's key")
+	}
+	root, rootKey = cert, signer
+
+	// containers (and ACME clients) trust it by mounting CertsDir
+	rootCopy := filepath.Join(config.CertsDir, "ca.crt")
+	if _, err := os.Stat(rootCopy); os.IsNotExist(err) {
+		if err := os.MkdirAll(config.CertsDir, 0755); err == nil {
+			ioutil.WriteFile(rootCopy, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+		}
+	}
+	return nil
+}
+
+func createRoot(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			Organization:       []string{"cirrid local CA"},
+			OrganizationalUnit: []string{hostname},
+			CommonName:         "cirrid local CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          keyID(&key.PublicKey),
+	}
+	for _, zone := range config.Zones {
+		template.PermittedDNSDomains = append(template.PermittedDNSDomains, strings.ToLower(strings.Trim(zone, ".")))
+	}
+	template.PermittedDNSDomainsCritical = len(template.PermittedDNSDomains) > 0
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	if logger != nil {
+		logger.Infof("Created the local CA in %s\n", filepath.Dir(certFile))
+	}
+	return nil
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+func keyID(pub *ecdsa.PublicKey) []byte {
+	sum := sha256.Sum256(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+	return sum[:20]
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Fingerprint is the cert's SHA-256, the way browsers show it
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// Allowed returns an error unless we answer for name, so we only vouch for our own names
+func Allowed(name string) error {
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("%s: the local CA only issues certs for names", name)
+	}
+	if !dns.Known(name) {
+		return fmt.Errorf("%s isn't a name cirrid answers for", name)
+	}
+	return nil
+}
+
+// Issue makes a leaf cert (and a new key) for names, returning them PEM encoded
+func Issue(names []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := Sign(names, &key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// Sign makes a leaf cert for names with someone else's key, returning it DER encoded
+func Sign(names []string, pub crypto.PublicKey) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names to issue a cert for")
+	}
+	names = append([]string{}, names...)
+	for i, name := range names {
+		names[i] = strings.ToLower(strings.TrimSuffix(name, "."))
+		if err := Allowed(names[i]); err != nil {
+			return nil, err
+		}
+	}
+	caLock.Lock()
+	defer caLock.Unlock()
+	if err := loadRoot(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := permitted(name); err != nil {
+			return nil, err
+		}
+	}
+	usage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		// only RSA keys are used for key transport (in TLS 1.2's RSA key exchange)
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			Organization: []string{"cirrid local CA"},
+			CommonName:   names[0],
+		},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(config.Lifetime),
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		AuthorityKeyId:        root.SubjectKeyId,
+	}
+	return x509.CreateCertificate(rand.Reader, template, root, pub, rootKey)
+}
+
+// permitted returns an error if the root's name constraints (the zones it was made for) don't cover name,
+// must be called with caLock held
+func permitted(name string) error {
+	if len(root.PermittedDNSDomains) == 0 {
+		return nil
+	}
+	bare := strings.TrimPrefix(name, "*.")
+	for _, domain := range root.PermittedDNSDomains {
+		if bare == domain || strings.HasSuffix(bare, "."+domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside the zones the local CA was made for (%s): 'sudo cirrid ca untrust', remove %s, and 'sudo cirrid ca trust' makes a new one for the current zones",
+		name, strings.Join(root.PermittedDNSDomains, ", "), config.Dir)
+}
+
+// GetCertificate is for tls.Config, issuing (and keeping) a cert for the name the client asked for
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, fmt.Errorf("no server name, the local CA can't pick a cert")
+	}
+	caLock.Lock()
+	cert, ok := issued[name]
+	caLock.Unlock()
+	if ok && !needsRenewal(cert.Leaf) {
+		return cert, nil
+	}
+
+	certPEM, keyPEM, err := Issue([]string{name})
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	pair.Leaf, _ = x509.ParseCertificate(pair.Certificate[0])
+	caLock.Lock()
+	if len(issued) >= maxIssued {
+		pruneIssued()
+	}
+	issued[name] = &pair
+	caLock.Unlock()
+	return &pair, nil
+}
+
+// pruneIssued drops the certs due for renewal, and if that isn't enough, the ones that expire soonest,
+// must be called with caLock held
+func pruneIssued() {
+	for name, cert := range issued {
+		if needsRenewal(cert.Leaf) {
+			delete(issued, name)
+		}
+	}
+	if len(issued) < maxIssued {
+		return
+	}
+	names := make([]string, 0, len(issued))
+	for name := range issued {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return issued[names[i]].Leaf.NotAfter.Before(issued[names[j]].Leaf.NotAfter)
+	})
+	for _, name := range names[:len(names)-maxIssued+1] {
+		delete(issued, name)
+	}
+}
+
+// needsRenewal is true once a third of the cert's life is left
+func needsRenewal(cert *x509.Certificate) bool {
+	if cert == nil {
+		return true
+	}
+	life := cert.NotAfter.Sub(cert.NotBefore)
+	return time.Until(cert.NotAfter) < life/3
+}
+
+// certFileName is the name certs for names are written to, *.x becomes _wildcard.x
+func certFileName(names []string) string {
+	return strings.Replace(names[0], "*", "_wildcard", 1)
+}
+
+// WriteCert issues a cert for names and writes it to CertsDir (as NAME.crt and NAME.key),
+// along with the root (ca.crt) so the dir is all a container needs
+func WriteCert(names []string) (Cert, error) {
+	certPEM, keyPEM, err := Issue(names)
+	if err != nil {
+		return Cert{}, err
+	}
+	caLock.Lock()
+	dir := config.CertsDir
+	if root == nil {
+		// removed since Issue
+		caLock.Unlock()
+		return Cert{}, fmt.Errorf("the local CA was removed while issuing a cert for %s", strings.Join(names, ", "))
+	}
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	caLock.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Cert{}, err
+	}
+	base := filepath.Join(dir, certFileName(names))
+	c := Cert{Names: names, CertFile: base + ".crt", KeyFile: base + ".key"}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), rootPEM, 0644); err != nil {
+		return c, err
+	}
+	// only root reads the key (chown it for containers running as someone else), and renewing
+	// keys written before this was so mustn't leave the new one readable by everyone
+	if err := os.Chmod(c.KeyFile, 0600); err != nil && !os.IsNotExist(err) {
+		return c, err
+	}
+	if err := ioutil.WriteFile(c.KeyFile, keyPEM, 0600); err != nil {
+		return c, err
+	}
+	if err := ioutil.WriteFile(c.CertFile, certPEM, 0644); err != nil {
+		return c, err
+	}
+	if leaf, err := parseCertFile(c.CertFile); err == nil {
+		c.NotAfter = leaf.NotAfter
+	}
+	return c, nil
+}
+
+func parseCertFile(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Certs lists the certs in CertsDir, sorted by name
+func Certs() []Cert {
+	caLock.Lock()
+	dir := config.CertsDir
+	caLock.Unlock()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.crt"))
+	sort.Strings(files)
+	certs := []Cert{}
+	for _, file := range files {
+		if filepath.Base(file) == "ca.crt" {
+			continue
+		}
+		leaf, err := parseCertFile(file)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, Cert{
+			Names:    leaf.DNSNames,
+			CertFile: file,
+			KeyFile:  strings.TrimSuffix(file, ".crt") + ".key",
+			NotAfter: leaf.NotAfter,
+		})
+	}
+	return certs
+}
+
+// KeepRenewed renews the certs in CertsDir before they expire, for as long as cirrid runs
+func KeepRenewed() {
+	for {
+		for _, c := range Certs() {
+			leaf, err := parseCertFile(c.CertFile)
+			if err != nil || !needsRenewal(leaf) {
+				continue
+			}
+			if _, err := WriteCert(c.Names); err != nil {
+				logger.Warningf("Can't renew %s: %s\n", c.CertFile, err)
+				continue
+			}
+			logger.Infof("Renewed %s\n", c.CertFile)
+		}
+		time.Sleep(renewCheck)
+	}
+}
+
+// GetInfo describes the CA, without making it if it isn't there yet
+func GetInfo() Info {
+	caLock.Lock()
+	info := Info{Dir: config.Dir, RootFile: filepath.Join(config.Dir, rootCertFile), CertsDir: config.CertsDir}
+	caLock.Unlock()
+	if cert, err := parseCertFile(info.RootFile); err == nil {
+		info.Subject = cert.Subject.CommonName
+		info.Fingerprint = Fingerprint(cert)
+		info.NotAfter = cert.NotAfter
+		info.Trusted = IsTrusted()
+	}
+	info.Certs = Certs()
+	return info
+}
+
+// Remove deletes the CA and the certs it issued, returning what was removed
+func Remove() ([]string, error) {
+	caLock.Lock()
+	defer caLock.Unlock()
+	removed := []string{}
+	for _, dir := range []string{config.CertsDir, config.Dir} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	root, rootKey = nil, nil
+	issued = map[string]*tls.Certificate{}
+	return removed, nil
+}
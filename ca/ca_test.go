@@ -0,0 +1,88 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/dns"
+)
+
+// useCA makes a CA in a temp dir, for ona.im, where cirrid answers for host.ona.im
+func useCA(t *testing.T) {
+	dir := t.TempDir()
+	Configure(Config{Dir: filepath.Join(dir, "ca"), CertsDir: filepath.Join(dir, "certs"), Zones: []string{"ona.im"}}, service.ConsoleLogger)
+	dns.SetLogger(service.ConsoleLogger)
+	dns.AddZone(dns.Zone{Name: "ona.im"})
+	if err := dns.AddRecord("ona.im", "host", "A 192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignKeyUsage(t *testing.T) {
+	useCA(t)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name  string
+		pub   crypto.PublicKey
+		usage x509.KeyUsage
+	}{
+		{"ecdsa", &ecKey.PublicKey, x509.KeyUsageDigitalSignature},
+		{"rsa", &rsaKey.PublicKey, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		{"ed25519", edPub, x509.KeyUsageDigitalSignature},
+	}
+	for _, tt := range tests {
+		der, err := Sign([]string{"host.ona.im"}, tt.pub)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.KeyUsage != tt.usage {
+			t.Errorf("%s: key usage %b, want %b", tt.name, leaf.KeyUsage, tt.usage)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	useCA(t)
+	for name, ok := range map[string]bool{
+		"host.ona.im": true,
+		"nope.ona.im": false,
+		// only an empty non-terminal above host.ona.im, its records are the world's
+		"ona.im":        false,
+		"example.org":   false,
+		"192.0.2.1":     false,
+		"*.nope.ona.im": false,
+	} {
+		if err := Allowed(name); (err == nil) != ok {
+			t.Errorf("Allowed(%q) = %v", name, err)
+		}
+	}
+}
+
+// a root made for ona.im won't sign for a zone added later
+func TestSignOutsideZones(t *testing.T) {
+	useCA(t)
+	dns.AddZone(dns.Zone{Name: "dev.test"})
+	if err := dns.AddRecord("dev.test", "app", "A 192.0.2.7"); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := Sign([]string{"app.dev.test"}, &key.PublicKey); err == nil {
+		t.Error("signed a name outside the root's name constraints")
+	}
+}
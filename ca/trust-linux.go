@@ -0,0 +1,96 @@
+// +build linux
+
+package ca
+
+// the distros keep their trusted roots in different places, with different tools to rebuild the bundle
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/onaci/cirrid/util"
+)
+
+type trustStore struct {
+	dir    string
+	update []string
+	// update-ca-certificates leaves the links to removed certs behind, unless it starts afresh
+	remove []string
+}
+
+var trustStores = []trustStore{
+	// debian, ubuntu, alpine
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}, []string{"update-ca-certificates", "--fresh"}},
+	// fedora, rhel, centos
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}, []string{"update-ca-trust", "extract"}},
+	// arch
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}, []string{"trust", "extract-compat"}},
+	// opensuse
+	{"/usr/share/pki/trust/anchors", []string{"update-ca-certificates"}, []string{"update-ca-certificates", "--fresh"}},
+}
+
+const trustedName = "cirrid-local-ca.crt"
+
+func findTrustStore() (trustStore, error) {
+	for _, store := range trustStores {
+		if _, err := os.Stat(store.dir); err == nil {
+			return store, nil
+		}
+	}
+	return trustStore{}, fmt.Errorf("can't find the system's trust store, add %s to it by hand", RootFile())
+}
+
+// Trust adds the root to the system trust store
+func Trust() error {
+	store, err := findTrustStore()
+	if err != nil {
+		return err
+	}
+	cert, err := ioutil.ReadFile(RootFile())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(store.dir, trustedName), cert, 0644); err != nil {
+		return err
+	}
+	if _, stderr, err := util.RunLocally(util.Options{}, store.update...); err != nil {
+		return fmt.Errorf("%s: %s %s", store.update[0], err, stderr)
+	}
+	return nil
+}
+
+// Untrust removes the root from the system trust store
+func Untrust() error {
+	store, err := findTrustStore()
+	if err != nil {
+		return nil
+	}
+	err = os.Remove(filepath.Join(store.dir, trustedName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, stderr, err := util.RunLocally(util.Options{}, store.remove...); err != nil {
+		return fmt.Errorf("%s: %s %s", store.remove[0], err, stderr)
+	}
+	return nil
+}
+
+// IsTrusted is true if the system trust store has our root
+func IsTrusted() bool {
+	store, err := findTrustStore()
+	if err != nil {
+		return false
+	}
+	trusted, err := ioutil.ReadFile(filepath.Join(store.dir, trustedName))
+	if err != nil {
+		return false
+	}
+	cert, err := ioutil.ReadFile(RootFile())
+	return err == nil && bytes.Equal(trusted, cert)
+}
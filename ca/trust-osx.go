@@ -0,0 +1,48 @@
+// +build darwin
+
+package ca
+
+import (
+	"crypto/sha1"
+	"fmt"
+
+	"github.com/onaci/cirrid/util"
+)
+
+const systemKeychain = "/Library/Keychains/System.keychain"
+
+// Trust adds the root to the system keychain, trusted for everything
+func Trust() error {
+	// sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain rootCA.pem
+	_, stderr, err := util.RunLocally(util.Options{}, "security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", systemKeychain, RootFile())
+	if err != nil {
+		return fmt.Errorf("security add-trusted-cert: %s %s", err, stderr)
+	}
+	return nil
+}
+
+// Untrust removes the root's trust settings, and the root, from the system keychain
+func Untrust() error {
+	if !IsTrusted() {
+		return nil
+	}
+	if _, stderr, err := util.RunLocally(util.Options{}, "security", "remove-trusted-cert", "-d", RootFile()); err != nil {
+		return fmt.Errorf("security remove-trusted-cert: %s %s", err, stderr)
+	}
+	cert, err := parseCertFile(RootFile())
+	if err != nil {
+		return err
+	}
+	// older versions of security only take the SHA-1
+	hash := fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+	if _, stderr, err := util.RunLocally(util.Options{}, "security", "delete-certificate", "-Z", hash, "-t", systemKeychain); err != nil {
+		return fmt.Errorf("security delete-certificate: %s %s", err, stderr)
+	}
+	return nil
+}
+
+// IsTrusted is true if the system will verify our root
+func IsTrusted() bool {
+	_, _, err := util.RunLocally(util.Options{}, "security", "verify-cert", "-c", RootFile())
+	return err == nil
+}
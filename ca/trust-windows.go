@@ -0,0 +1,49 @@
+// +build windows
+
+package ca
+
+import (
+	"fmt"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// Trust adds the root to the machine's Trusted Root Certification Authorities
+func Trust() error {
+	// certutil -addstore -f ROOT rootCA.pem
+	if _, stderr, err := util.RunLocally(util.Options{}, "certutil", "-addstore", "-f", "ROOT", RootFile()); err != nil {
+		return fmt.Errorf("certutil -addstore: %s %s", err, stderr)
+	}
+	return nil
+}
+
+// Untrust removes the root from the machine's Trusted Root Certification Authorities
+func Untrust() error {
+	serial, err := rootSerial()
+	if err != nil || !IsTrusted() {
+		return nil
+	}
+	if _, stderr, err := util.RunLocally(util.Options{}, "certutil", "-delstore", "ROOT", serial); err != nil {
+		return fmt.Errorf("certutil -delstore: %s %s", err, stderr)
+	}
+	return nil
+}
+
+// IsTrusted is true if the machine's root store has our root
+func IsTrusted() bool {
+	serial, err := rootSerial()
+	if err != nil {
+		return false
+	}
+	_, _, err = util.RunLocally(util.Options{}, "certutil", "-verifystore", "ROOT", serial)
+	return err == nil
+}
+
+// certutil finds certs by serial number, in hex
+func rootSerial() (string, error) {
+	cert, err := parseCertFile(RootFile())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", cert.SerialNumber), nil
+}
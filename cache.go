@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+)
+
+// flushResult is the reply to a POST to /cache/flush
+type flushResult struct {
+	Flushed int
+}
+
+func registerCacheHandlers() {
+	control.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, dns.GetCacheStats())
+	})
+	control.HandlePrivileged("/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to flush", http.StatusMethodNotAllowed)
+			return
+		}
+		control.WriteJSON(w, flushResult{Flushed: dns.FlushCache()})
+	})
+}
+
+// `cirrid cache [stats]|flush` - the cache of forwarded DNS answers
+func cacheCmd(args []string) error {
+	if len(args) == 0 {
+		args = []string{"stats"}
+	}
+	switch args[0] {
+	case "stats":
+		return cacheStats(args[1:])
+	case "flush":
+		requirePrivileges("cache flush")
+		return cacheFlush(args[1:])
+	}
+	return fmt.Errorf("usage: cirrid cache stats|flush")
+}
+
+func cacheStats(args []string) error {
+	flags := flag.NewFlagSet("cache stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output the raw cache stats json")
+	flags.Parse(args)
+
+	var stats dns.CacheStats
+	if err := control.Get("/cache", &stats); err != nil {
+		return err
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	if stats.Size <= 0 {
+		fmt.Printf("the DNS cache is off (size = 0 in [cache])\n")
+		return nil
+	}
+	fmt.Printf("%d of %d answers cached\n", stats.Entries, stats.Size)
+	fmt.Printf("  %d hits, %d misses, %d prefetches, %d evictions\n", stats.Hits, stats.Misses, stats.Prefetches, stats.Evictions)
+	return nil
+}
+
+func cacheFlush(args []string) error {
+	flags := flag.NewFlagSet("cache flush", flag.ExitOnError)
+	flags.Parse(args)
+
+	var result flushResult
+	if err := control.Post("/cache/flush", nil, &result); err != nil {
+		return err
+	}
+	fmt.Printf("flushed %d answers from the DNS cache\n", result.Flushed)
+	return nil
+}
@@ -0,0 +1,455 @@
+package main
+
+// turn the /etc/cirrid.ini settings into dns zones and records
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/onaci/cirrid/acme"
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/install"
+	"github.com/onaci/cirrid/proxy"
+	"github.com/onaci/cirrid/remote"
+
+	"gopkg.in/ini.v1"
+)
+
+// zoneConfig is a zone's settings, and the ini sections listing its hosts and other records
+type zoneConfig struct {
+	zone    dns.Zone
+	hosts   []*ini.Section
+	records []*ini.Section
+}
+
+// sectionArg returns NAME for an ini section named `kind "NAME"`
+func sectionArg(section, kind string) (string, bool) {
+	prefix := kind + ` "`
+	if !strings.HasPrefix(section, prefix) || !strings.HasSuffix(section, `"`) || len(section) <= len(prefix)+1 {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(section, prefix), `"`), true
+}
+
+func zoneFromSection(name string, sec *ini.Section, defaults dns.Zone) dns.Zone {
+	z := defaults
+	z.Name = strings.ToLower(strings.Trim(name, "."))
+	z.TTL = uint32(sec.Key("ttl").MustUint(uint(defaults.TTL)))
+	z.Wildcard = sec.Key("wildcard").MustBool(defaults.Wildcard)
+	z.UseHostname = sec.Key("use_hostname").MustBool(defaults.UseHostname)
+	z.AskCirri = sec.Key("ask_cirri").MustBool(defaults.AskCirri)
+	if sec.HasKey("forward") {
+		z.Forward = forwardServers(z.Name, sec.Key("forward").Strings(","))
+	}
+	return z
+}
+
+// forwardServers turns a zone's forward = list into ip:port addresses, skipping (and warning about) anything else
+func forwardServers(zone string, values []string) []string {
+	servers := []string{}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			host, port = strings.Trim(value, "[]"), "53"
+		}
+		if p, err := strconv.Atoi(port); net.ParseIP(host) == nil || err != nil || p < 1 || p > 65535 {
+			logger.Warningf("Zone %s: ignoring forward server %q, it should be an IP address, with an optional :port\n", zone, value)
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(host, port))
+	}
+	return servers
+}
+
+// readZones returns the global zone (from the top of the file, [hosts] and [records]),
+// and every [zone "name"] section, with its [hosts "name"] and [records "name"] sections
+func readZones(cfg *ini.File) []*zoneConfig {
+	list := []*zoneConfig{}
+	byName := map[string]*zoneConfig{}
+
+	global := cfg.Section("")
+	if name := global.Key("zone").String(); name != "" {
+		zc := &zoneConfig{
+			zone: zoneFromSection(name, global, dns.Zone{
+				TTL:         dns.DefaultTTL,
+				Wildcard:    true,
+				UseHostname: true,
+				AskCirri:    true,
+			}),
+			hosts:   []*ini.Section{cfg.Section("hosts")},
+			records: []*ini.Section{cfg.Section("records")},
+		}
+		list = append(list, zc)
+		byName[zc.zone.Name] = zc
+	}
+
+	for _, sec := range cfg.Sections() {
+		name, ok := sectionArg(sec.Name(), "zone")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.Trim(name, "."))
+		if zc, ok := byName[name]; ok {
+			// a [zone] section for the global zone overrides the global settings
+			zc.zone = zoneFromSection(name, sec, zc.zone)
+			continue
+		}
+		zc := &zoneConfig{
+			zone: zoneFromSection(name, sec, dns.Zone{
+				TTL:      dns.DefaultTTL,
+				Wildcard: true,
+			}),
+		}
+		list = append(list, zc)
+		byName[name] = zc
+	}
+
+	for _, sec := range cfg.Sections() {
+		for _, kind := range []string{"hosts", "records"} {
+			name, ok := sectionArg(sec.Name(), kind)
+			if !ok {
+				continue
+			}
+			zc, ok := byName[strings.ToLower(strings.Trim(name, "."))]
+			if !ok {
+				logger.Warningf("Ignoring [%s], there's no matching [zone \"%s\"]\n", sec.Name(), name)
+				continue
+			}
+			if kind == "hosts" {
+				zc.hosts = append(zc.hosts, sec)
+			} else {
+				zc.records = append(zc.records, sec)
+			}
+		}
+	}
+	return list
+}
+
+// configureDNS registers all the zones and hosts from the cfg file
+func configureDNS(cfg *ini.File) {
+	dns.SetUpstream(strings.Split(cfg.Section("").Key("upstream").MustString("system"), ","))
+	logger.Infof("Names we don't have are asked of %v\n", dns.Upstream())
+	dns.ConfigureCache(readCache(cfg))
+	for _, zc := range readZones(cfg) {
+		z := zc.zone
+		logger.Infof("Zone %s (ttl %d, wildcard %v, forward %v)\n", z.Name, z.TTL, z.Wildcard, z.Forward)
+		dns.AddZone(z)
+
+		if z.UseHostname {
+			setDNSValue(dns.GetHostname(), z.Name, "magic")
+		}
+		for _, sec := range zc.hosts {
+			for _, key := range sec.Keys() {
+				setHostEntry(key.Name(), z.Name, key.MustString("magic"))
+			}
+		}
+		for _, sec := range zc.records {
+			for _, key := range sec.Keys() {
+				for _, value := range key.ValueWithShadows() {
+					if err := dns.AddRecord(z.Name, key.Name(), value); err != nil {
+						logger.Errorf("Skipping record %s = %s: %s\n", key.Name(), value, err)
+					}
+				}
+			}
+		}
+	}
+	publishCirriStackdomain()
+
+	dns.EnsureWildCards()
+}
+
+// publishCirriStackdomain publishes the cirri container's STACKDOMAIN in the zones that ask for it,
+// replacing the one from before (the docker context may have changed)
+func publishCirriStackdomain() {
+	stackdomain := ""
+	askedCirri := false
+	for _, z := range dns.Zones() {
+		if !z.AskCirri {
+			continue
+		}
+		if !askedCirri {
+			stackdomain = dns.GetCirriStackdomain()
+			askedCirri = true
+		}
+		hosts := []dns.Host{}
+		if stackdomain != "" {
+			hosts = append(hosts, dns.Host{Name: stackdomain, Address: dns.GetMagic().Address})
+		}
+		if err := dns.Publish("cirri "+z.Name, z.Name, hosts); err != nil {
+			logger.Errorf("Skipping %s: %s\n", stackdomain, err)
+		}
+	}
+}
+
+// readDockerContext returns the [docker] context cirrid follows, and its endpoint (empty for the local docker)
+func readDockerContext(cfg *ini.File) (name, host string) {
+	sec := cfg.Section("docker")
+	return sec.Key("context").String(), sec.Key("host").String()
+}
+
+// readCache returns the [cache] settings for forwarded answers
+func readCache(cfg *ini.File) dns.CacheConfig {
+	sec := cfg.Section("cache")
+	return dns.CacheConfig{
+		Size:     sec.Key("size").MustInt(dns.DefaultCacheSize),
+		MaxTTL:   sec.Key("max_ttl").MustDuration(dns.DefaultCacheMaxTTL),
+		Prefetch: sec.Key("prefetch").MustBool(true),
+	}
+}
+
+// readCA returns the [ca] settings: where the local CA lives, and how long its certs last
+func readCA(cfg *ini.File) ca.Config {
+	sec := cfg.Section("ca")
+	return ca.Config{
+		Dir:      sec.Key("dir").MustString(ca.DefaultDir),
+		CertsDir: sec.Key("certs").MustString(ca.DefaultCertsDir),
+		Lifetime: sec.Key("lifetime").MustDuration(ca.DefaultLifetime),
+		Zones:    caZones(cfg),
+	}
+}
+
+// caZones are the zones cirrid publishes names in, which a new local CA is constrained to
+func caZones(cfg *ini.File) []string {
+	zones := []string{}
+	seen := map[string]bool{}
+	add := func(zone string) {
+		zone = strings.ToLower(strings.Trim(zone, "."))
+		if zone != "" && !seen[zone] {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+	add(cfg.Section("").Key("zone").String())
+	for _, sec := range cfg.Sections() {
+		if name, ok := sectionArg(sec.Name(), "zone"); ok {
+			add(name)
+		}
+		// remotes and tunnels can publish in zones of their own
+		_, isRemote := sectionArg(sec.Name(), "remote")
+		_, isTunnel := sectionArg(sec.Name(), "tunnel")
+		if isRemote || isTunnel {
+			add(sec.Key("zone").String())
+		}
+	}
+	return zones
+}
+
+// readACME returns the [acme] settings, and whether the ACME server is enabled
+func readACME(cfg *ini.File) (acme.Config, bool) {
+	sec := cfg.Section("acme")
+	c := acme.Config{
+		Listen:   sec.Key("listen").MustString("magic"),
+		Port:     sec.Key("port").MustInt(acme.DefaultPort),
+		Name:     sec.Key("name").MustString("acme"),
+		Zone:     strings.Trim(cfg.Section("").Key("zone").String(), "."),
+		Dir:      sec.Key("dir").MustString(acme.DefaultDir),
+		HTTPPort: sec.Key("http01_port").MustInt(80),
+	}
+	return c, sec.Key("enable").MustBool(false)
+}
+
+// readSecureDNS returns the [secure_dns] settings (with the certificate to use), and whether DoH and DoT are enabled
+func readSecureDNS(cfg *ini.File) (dns.SecureConfig, bool, error) {
+	sec := cfg.Section("secure_dns")
+	c := dns.SecureConfig{
+		Address: sec.Key("listen").MustString("magic"),
+		Name:    sec.Key("name").MustString("dns"),
+		DoHPort: sec.Key("doh").MustInt(8053),
+		DoTPort: sec.Key("dot").MustInt(853),
+		Zone:    strings.Trim(cfg.Section("").Key("zone").String(), "."),
+	}
+	enabled := sec.Key("enable").MustBool(false)
+	if !enabled {
+		return c, false, nil
+	}
+	if cert := sec.Key("cert").MustString("ca"); cert != "ca" {
+		pair, err := tls.LoadX509KeyPair(cert, sec.Key("key").String())
+		if err != nil {
+			return c, true, err
+		}
+		c.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+		return c, true, nil
+	}
+	// clients need to trust it (ca.crt) before they can talk to us
+	if _, err := ca.Root(); err != nil {
+		return c, true, err
+	}
+	c.TLS = &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// DoT clients given just an address don't say which name they want
+		if hello.ServerName == "" {
+			hello.ServerName = c.Name + "." + c.Zone
+		}
+		return ca.GetCertificate(hello)
+	}}
+	return c, true, nil
+}
+
+// setHostEntry handles a `name = IP[, wildcard|nowildcard]` entry from a hosts section
+func setHostEntry(hostname, zone, value string) {
+	fields := strings.Split(value, ",")
+	setDNSValue(hostname, zone, strings.TrimSpace(fields[0]))
+	for _, option := range fields[1:] {
+		switch strings.TrimSpace(option) {
+		case "wildcard":
+			dns.SetWildcard(hostname, zone, true)
+		case "nowildcard":
+			dns.SetWildcard(hostname, zone, false)
+		default:
+			logger.Warningf("Ignoring unknown option %q for %s\n", option, hostname)
+		}
+	}
+}
+
+func setDNSValue(hostname, zone, ipAddress string) {
+	if err := dns.SetDNSValue(hostname, zone, ipAddress); err != nil {
+		logger.Errorf("Skipping %s: %s\n", hostname, err)
+	}
+}
+
+// readRemotes returns the [remote "name"] sections - their names go in the global zone unless they say otherwise
+func readRemotes(cfg *ini.File) []remote.Host {
+	hosts := []remote.Host{}
+	for _, sec := range cfg.Sections() {
+		name, ok := sectionArg(sec.Name(), "remote")
+		if !ok {
+			continue
+		}
+		h := remote.Host{
+			Name:       strings.ToLower(name),
+			SSH:        sec.Key("host").MustString(name),
+			Zone:       sec.Key("zone").MustString(cfg.Section("").Key("zone").String()),
+			Address:    sec.Key("address").String(),
+			Refresh:    sec.Key("refresh").MustDuration(remote.DefaultRefresh),
+			Containers: sec.Key("containers").MustBool(true),
+		}
+		if h.Zone == "" {
+			logger.Warningf("Ignoring [%s], it has no zone to publish names in\n", sec.Name())
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// readTunnels returns the [tunnel "name"] sections, which go through a [remote]'s ssh host, or their own
+func readTunnels(cfg *ini.File, remotes []remote.Host) []remote.Tunnel {
+	tunnels := []remote.Tunnel{}
+	for _, sec := range cfg.Sections() {
+		name, ok := sectionArg(sec.Name(), "tunnel")
+		if !ok {
+			continue
+		}
+		t := remote.Tunnel{
+			Name:    strings.ToLower(name),
+			SSH:     sec.Key("host").String(),
+			Zone:    sec.Key("zone").MustString(cfg.Section("").Key("zone").String()),
+			Address: sec.Key("address").MustString(remote.TunnelAddress(len(tunnels))),
+			To:      sec.Key("to").MustString("localhost"),
+		}
+		if via := sec.Key("remote").String(); via != "" {
+			for _, h := range remotes {
+				if h.Name == strings.ToLower(via) {
+					t.SSH = h.SSH
+					if !sec.HasKey("zone") {
+						t.Zone = h.Zone
+					}
+				}
+			}
+			if t.SSH == "" {
+				logger.Warningf("Ignoring [%s], there's no [remote \"%s\"]\n", sec.Name(), via)
+				continue
+			}
+		}
+		if t.SSH == "" {
+			logger.Warningf("Ignoring [%s], it needs a remote or host setting\n", sec.Name())
+			continue
+		}
+		if ip := net.ParseIP(t.Address); ip == nil || !ip.IsLoopback() {
+			logger.Warningf("Ignoring [%s], address %s is not a loopback address\n", sec.Name(), t.Address)
+			continue
+		}
+		ports, err := remote.ParsePorts(sec.Key("ports").String())
+		if err != nil {
+			logger.Warningf("Ignoring [%s]: %s\n", sec.Name(), err)
+			continue
+		}
+		t.Ports = ports
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// readVolumes returns the [volume "name"] sections, which go to a [remote]'s ssh host, or their own
+func readVolumes(cfg *ini.File, remotes []remote.Host) []remote.Volume {
+	volumes := []remote.Volume{}
+	for _, sec := range cfg.Sections() {
+		name, ok := sectionArg(sec.Name(), "volume")
+		if !ok {
+			continue
+		}
+		v := remote.Volume{
+			Name:     name,
+			SSH:      sec.Key("host").String(),
+			Local:    sec.Key("local").String(),
+			Path:     sec.Key("path").String(),
+			Exclude:  sec.Key("exclude").Strings(","),
+			Interval: sec.Key("interval").MustDuration(remote.DefaultVolumeInterval),
+		}
+		if via := sec.Key("remote").String(); via != "" {
+			for _, h := range remotes {
+				if h.Name == strings.ToLower(via) {
+					v.SSH = h.SSH
+				}
+			}
+		}
+		if v.SSH == "" || v.Local == "" {
+			logger.Warningf("Ignoring [%s], it needs a remote (or host) and a local dir\n", sec.Name())
+			continue
+		}
+		if v.Path == "" {
+			v.Path = v.Local
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes
+}
+
+// readProxy returns the [proxy] settings, and the [routes] (names relative to the global zone, unless they end in '.')
+func readProxy(cfg *ini.File) (proxy.Config, bool) {
+	sec := cfg.Section("proxy")
+	c := proxy.Config{
+		Listen:    sec.Key("listen").MustString("magic"),
+		HTTPPort:  sec.Key("http").MustInt(80),
+		HTTPSPort: sec.Key("https").MustInt(443),
+		CertFile:  sec.Key("cert").String(),
+		KeyFile:   sec.Key("key").String(),
+		Docker:    sec.Key("docker").MustBool(true),
+		Routes:    map[string]string{},
+	}
+	zone := strings.Trim(cfg.Section("").Key("zone").String(), ".")
+	for _, key := range cfg.Section("routes").Keys() {
+		host := key.Name()
+		if !strings.HasSuffix(host, ".") && zone != "" {
+			host += "." + zone
+		}
+		c.Routes[strings.ToLower(strings.TrimSuffix(host, "."))] = key.String()
+	}
+	return c, sec.Key("enable").MustBool(false)
+}
+
+// configureInstall applies the [install] and [update] settings
+func configureInstall(cfg *ini.File) {
+	install.RequireSigned = cfg.Section("install").Key("require_signed").MustBool(install.RequireSigned)
+
+	sec := cfg.Section("update")
+	if url := sec.Key("url").String(); url != "" {
+		install.ReleasesURL = url
+	}
+	install.Prerelease = sec.Key("prerelease").MustBool(install.Prerelease)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kardianos/service"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestReadZones(t *testing.T) {
+	logger = service.ConsoleLogger
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, []byte(`
+zone = ona.im
+ttl = 30
+
+[hosts]
+host = 192.0.2.1
+
+[zone "ona.im"]
+wildcard = false
+
+[zone "Dev.Test."]
+forward = 10.0.0.2, , 10.0.0.3:5353, [2001:db8::53], ns.example.org, 10.0.0.4:dns, 10.0.0.5:99999
+
+[hosts "dev.test"]
+app = 192.0.2.7
+
+[records "nowhere"]
+www = CNAME app.dev.test.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zcs := readZones(cfg)
+	if len(zcs) != 2 {
+		t.Fatalf("got %d zones", len(zcs))
+	}
+
+	global := zcs[0].zone
+	if global.Name != "ona.im" || global.TTL != 30 || global.Wildcard || !global.UseHostname || len(global.Forward) != 0 {
+		t.Errorf("global zone %+v", global)
+	}
+	if len(zcs[0].hosts) != 1 || !zcs[0].hosts[0].HasKey("host") {
+		t.Errorf("global zone hosts %v", zcs[0].hosts)
+	}
+
+	dev := zcs[1].zone
+	if dev.Name != "dev.test" || dev.TTL != 60 || !dev.Wildcard || dev.UseHostname {
+		t.Errorf("dev.test zone %+v", dev)
+	}
+	// the malformed and empty entries are dropped, the rest get a port
+	if want := []string{"10.0.0.2:53", "10.0.0.3:5353", "[2001:db8::53]:53"}; !reflect.DeepEqual(dev.Forward, want) {
+		t.Errorf("forward %q, want %q", dev.Forward, want)
+	}
+	if len(zcs[1].hosts) != 1 || len(zcs[1].records) != 0 {
+		t.Errorf("dev.test has %d hosts and %d records sections", len(zcs[1].hosts), len(zcs[1].records))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/util"
+)
+
+// dockerContext is the docker context the daemon follows
+type dockerContext struct {
+	Name  string
+	Host  string
+	Magic dns.MagicStatus
+}
+
+var currentContext string
+var contextLock sync.Mutex
+
+func setCurrentContext(name string) {
+	contextLock.Lock()
+	defer contextLock.Unlock()
+	currentContext = name
+}
+
+func getDockerContext() dockerContext {
+	contextLock.Lock()
+	name := currentContext
+	contextLock.Unlock()
+	return dockerContext{Name: name, Host: util.DockerHost(), Magic: dns.GetMagic()}
+}
+
+func registerContextHandlers() {
+	control.HandleFunc("/context", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, getDockerContext())
+	})
+	// re-read the [docker] settings, after `cirrid context use` changed them
+	control.HandlePrivileged("/context/reload", func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := loadCfgFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		followDockerContext(readDockerContext(cfg))
+		control.WriteJSON(w, getDockerContext())
+	})
+}
+
+// followDockerContext points cirrid's docker commands at the context's endpoint, and moves
+// the magic names (and the cirri STACKDOMAIN) to wherever the stack now runs
+func followDockerContext(name, host string) {
+	logger.Infof("Following docker context %q (%s)\n", name, host)
+	setCurrentContext(name)
+	util.SetDockerHost(host)
+
+	dns.WithResolverLock(func() {
+		before := dns.RoutingDomains()
+		dns.RefreshMagic()
+		publishCirriStackdomain()
+		if !reflect.DeepEqual(before, dns.RoutingDomains()) {
+			dns.EnsureResolveConfigured(logger)
+		}
+		// the old addresses are likely cached
+		dns.ResetHostServices(logger)
+	})
+}
+
+// `cirrid context use|ls` - switch docker contexts, with cirrid's names following along
+func contextCmd(args []string) error {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	switch args[0] {
+	case "ls":
+		return contextLs(args[1:])
+	case "use":
+		requirePrivileges("context use")
+		return contextUse(args[1:])
+	}
+	return fmt.Errorf("usage: cirrid context use|ls")
+}
+
+// dockerAsUser runs docker as the user (not root, when we're under sudo), so it's their docker contexts
+func dockerAsUser(args ...string) (string, error) {
+	cmdline := append([]string{"docker"}, args...)
+	if user := os.Getenv("SUDO_USER"); user != "" && util.IsPrivileged() {
+		cmdline = append([]string{"sudo", "-u", user}, cmdline...)
+	}
+	out, _, err := util.RunLocally(util.Options{Timeout: util.DockerTimeout}, cmdline...)
+	return strings.TrimSpace(out), err
+}
+
+func contextLs(args []string) error {
+	flags := flag.NewFlagSet("context ls", flag.ExitOnError)
+	flags.Parse(args)
+
+	out, err := dockerAsUser("context", "ls", "--format", "{{.Name}}\t{{.DockerEndpoint}}\t{{.Current}}")
+	if err != nil {
+		return err
+	}
+	var following dockerContext
+	if err := control.Get("/context", &following); err != nil {
+		fmt.Printf("%s\n\n", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tENDPOINT\tDOCKER\tCIRRID\n")
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		docker, cirrid := "", ""
+		if fields[2] == "true" {
+			docker = "*"
+		}
+		if fields[0] == following.Name || following.Name == "" && fields[0] == "default" {
+			cirrid = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", fields[0], fields[1], docker, cirrid)
+	}
+	return w.Flush()
+}
+
+func contextUse(args []string) error {
+	flags := flag.NewFlagSet("context use", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: cirrid context use NAME\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("which docker context?")
+	}
+	name := flags.Arg(0)
+
+	host, err := dockerAsUser("context", "inspect", name, "--format", "{{.Endpoints.docker.Host}}")
+	if err != nil {
+		return fmt.Errorf("docker context %s: %s", name, err)
+	}
+	if _, err := util.RemoteDockerHost(host); err != nil {
+		return err
+	}
+	if _, err := dockerAsUser("context", "use", name); err != nil {
+		return fmt.Errorf("docker context use %s: %s", name, err)
+	}
+	if os.Getenv("DOCKER_HOST") != "" {
+		fmt.Printf("DOCKER_HOST is set, and overrides docker contexts - unset it to use %s\n", name)
+	}
+
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	sec := cfg.Section("docker")
+	sec.Key("context").SetValue(name)
+	sec.Key("host").SetValue(host)
+	if err := cfg.SaveTo(globalCfgFile); err != nil {
+		return err
+	}
+
+	var following dockerContext
+	if err := control.Post("/context/reload", nil, &following); err != nil {
+		fmt.Printf("using docker context %s (%s), the daemon will follow it when it next starts: %s\n", name, host, err)
+		return nil
+	}
+	fmt.Printf("using docker context %s (%s), magic names now point at %s (%s)\n", name, host, following.Magic.Address, following.Magic.Reason)
+	return nil
+}
@@ -0,0 +1,51 @@
+// +build !windows
+
+package control
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+)
+
+var SocketPath = "/var/run/cirrid.sock"
+
+func listen() (net.Listener, error) {
+	// clean up after a daemon that didn't exit cleanly
+	if err := os.Remove(SocketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	// anyone can ask for the read only endpoints, HandlePrivileged checks the rest
+	if err := os.Chmod(SocketPath, 0666); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", SocketPath)
+			},
+		},
+	}
+}
+
+// RemoveSocket cleans up the socket a stopped daemon left behind
+func RemoveSocket() (string, error) {
+	if err := os.Remove(SocketPath); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return SocketPath, nil
+}
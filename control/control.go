@@ -0,0 +1,112 @@
+package control
+
+// the control API lets cirrid commands (like `cirrid status`) talk to the running daemon
+// it's plain HTTP+JSON over a local socket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/kardianos/service"
+)
+
+var mux = http.NewServeMux()
+var logger service.Logger
+
+type connKey struct{}
+
+// HandleFunc registers a read only control API endpoint, that anyone on the host can use
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(pattern, handler)
+}
+
+// HandlePrivileged registers a control API endpoint that only root can use
+func HandlePrivileged(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		conn, _ := r.Context().Value(connKey{}).(net.Conn)
+		uid, err := peerUID(conn)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("can't check who you are: %s", err), http.StatusForbidden)
+			return
+		}
+		if uid != 0 {
+			http.Error(w, "this needs root, use sudo", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// WriteJSON sends v as the JSON reply
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Errorf("control api: %s\n", err)
+	}
+}
+
+// Serve runs the control API until the listener fails
+func Serve(l service.Logger) {
+	logger = l
+
+	listener, err := listen()
+	if err != nil {
+		logger.Errorf("Failed to start control api listener: %s\n", err)
+		return
+	}
+	logger.Infof("Control api listening on %s\n", listener.Addr())
+	srv := &http.Server{
+		Handler: mux,
+		// so HandlePrivileged can see who's asking
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+	if err := srv.Serve(listener); err != nil {
+		logger.Errorf("Control api stopped: %s\n", err)
+	}
+}
+
+// Get asks the running daemon for path, and decodes the JSON reply into v
+func Get(path string, v interface{}) error {
+	resp, err := client().Get("http://cirrid" + path)
+	return decodeReply(resp, err, v)
+}
+
+// Post sends body (as JSON, if its not nil) to path on the running daemon, and decodes the JSON reply into v
+func Post(path string, body, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	resp, err := client().Post("http://cirrid"+path, "application/json", bytes.NewReader(data))
+	return decodeReply(resp, err, v)
+}
+
+func decodeReply(resp *http.Response, err error, v interface{}) error {
+	if err != nil {
+		return fmt.Errorf("can't talk to the cirrid daemon (is it running?): %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cirrid daemon: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
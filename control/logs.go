@@ -0,0 +1,94 @@
+package control
+
+// keep the daemon's recent log lines, so `cirrid logs` can show them without root
+// (or knowing whether they went to journald, syslog or the windows event log)
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// LogLine is one line of daemon log
+type LogLine struct {
+	Seq   int64
+	Time  time.Time
+	Level string
+	Text  string
+}
+
+const logBufferSize = 1000
+
+var logLock sync.Mutex
+var logLines []LogLine
+var logSeq int64
+
+// teeLogger passes everything on to the real logger, and keeps a copy
+type teeLogger struct {
+	service.Logger
+}
+
+// TeeLogger wraps l so its recent lines are served by the control api at /logs
+func TeeLogger(l service.Logger) service.Logger {
+	return teeLogger{l}
+}
+
+func keepLogLine(level string, text string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logSeq++
+	logLines = append(logLines, LogLine{Seq: logSeq, Time: time.Now(), Level: level, Text: text})
+	if len(logLines) > logBufferSize {
+		logLines = logLines[len(logLines)-logBufferSize:]
+	}
+}
+
+func (t teeLogger) Error(v ...interface{}) error {
+	keepLogLine("error", fmt.Sprint(v...))
+	return t.Logger.Error(v...)
+}
+func (t teeLogger) Warning(v ...interface{}) error {
+	keepLogLine("warning", fmt.Sprint(v...))
+	return t.Logger.Warning(v...)
+}
+func (t teeLogger) Info(v ...interface{}) error {
+	keepLogLine("info", fmt.Sprint(v...))
+	return t.Logger.Info(v...)
+}
+func (t teeLogger) Errorf(format string, a ...interface{}) error {
+	keepLogLine("error", fmt.Sprintf(format, a...))
+	return t.Logger.Errorf(format, a...)
+}
+func (t teeLogger) Warningf(format string, a ...interface{}) error {
+	keepLogLine("warning", fmt.Sprintf(format, a...))
+	return t.Logger.Warningf(format, a...)
+}
+func (t teeLogger) Infof(format string, a ...interface{}) error {
+	keepLogLine("info", fmt.Sprintf(format, a...))
+	return t.Logger.Infof(format, a...)
+}
+
+// RecentLogs returns the kept lines after seq since
+func RecentLogs(since int64) []LogLine {
+	logLock.Lock()
+	defer logLock.Unlock()
+	lines := []LogLine{}
+	for _, l := range logLines {
+		if l.Seq > since {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func init() {
+	// /logs?since=SEQ
+	HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		WriteJSON(w, RecentLogs(since))
+	})
+}
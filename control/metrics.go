@@ -0,0 +1,106 @@
+package control
+
+// a minimal prometheus text format /metrics endpoint
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kardianos/service"
+)
+
+type metric struct {
+	help   string
+	kind   string
+	values map[string]float64
+}
+
+var metricsLock sync.Mutex
+var metrics = map[string]*metric{}
+
+func init() {
+	HandleFunc("/metrics", serveMetrics)
+}
+
+// labelString turns label pairs ("name", "value", ...) into `{name="value",...}`
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func getMetric(name, help, kind string) *metric {
+	m, ok := metrics[name]
+	if !ok {
+		m = &metric{help: help, kind: kind, values: map[string]float64{}}
+		metrics[name] = m
+	}
+	return m
+}
+
+// SetGauge sets a gauge, with optional label pairs ("name", "value", ...)
+func SetGauge(name, help string, value float64, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	getMetric(name, help, "gauge").values[labelString(labels)] = value
+}
+
+// ResetGauge removes all the values of a gauge, so labels that are no longer true go away
+func ResetGauge(name string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if m, ok := metrics[name]; ok {
+		m.values = map[string]float64{}
+	}
+}
+
+// AddCounter adds delta to a counter, with optional label pairs ("name", "value", ...)
+func AddCounter(name, help string, delta float64, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	getMetric(name, help, "counter").values[labelString(labels)] += delta
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := metrics[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.kind)
+		labels := make([]string, 0, len(m.values))
+		for l := range m.values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s%s %g\n", name, l, m.values[l])
+		}
+	}
+}
+
+// ServeMetrics also serves /metrics over TCP on address, for prometheus to scrape
+func ServeMetrics(l service.Logger, address string) {
+	logger = l
+	m := http.NewServeMux()
+	m.HandleFunc("/metrics", serveMetrics)
+	logger.Infof("Metrics listening on %s\n", address)
+	if err := http.ListenAndServe(address, m); err != nil {
+		logger.Errorf("Metrics listener stopped: %s\n", err)
+	}
+}
@@ -0,0 +1,298 @@
+package dns
+
+// a bounded cache of the answers we forward upstream, so every lookup doesn't go over the network.
+// Answers are kept for their TTL, and "no such name" (or no such type) answers for the negative
+// TTL in their SOA (RFC 2308). Names that keep being asked for are fetched again before they expire.
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/onaci/cirrid/control"
+)
+
+// CacheConfig is the [cache] section from the cfg file
+type CacheConfig struct {
+	// how many answers to keep, 0 turns the cache off
+	Size   int
+	MaxTTL time.Duration
+	// fetch popular names again before they expire
+	Prefetch bool
+}
+
+// CacheStats is how the cache is doing, for `cirrid cache`
+type CacheStats struct {
+	Size       int
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	Prefetches uint64
+	Evictions  uint64
+}
+
+const DefaultCacheSize = 10000
+const DefaultCacheMaxTTL = 24 * time.Hour
+
+// RFC 2308 section 5 suggests negative answers aren't kept for more than a few hours
+const maxNegativeTTL = 3 * time.Hour
+
+// a hit on an answer that's been asked for at least prefetchHits times, with less than
+// 1/prefetchFraction of its TTL left, fetches it again in the background
+const prefetchHits = 3
+const prefetchFraction = 10
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// DNSSEC OK changes what upstream sends back
+	do bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	servers     []string
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+	element     *list.Element
+}
+
+// guards cacheConfig, cache, cacheOrder and cacheStats
+var cacheLock sync.Mutex
+var cacheConfig = CacheConfig{Size: DefaultCacheSize, MaxTTL: DefaultCacheMaxTTL, Prefetch: true}
+var cache = map[cacheKey]*cacheEntry{}
+
+// most recently used at the front
+var cacheOrder = list.New()
+var cacheStats CacheStats
+
+// ConfigureCache sets the cache's size and limits, dropping answers that no longer fit
+func ConfigureCache(c CacheConfig) {
+	if c.MaxTTL <= 0 {
+		c.MaxTTL = DefaultCacheMaxTTL
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	cacheConfig = c
+	for len(cache) > c.Size {
+		evictOldest()
+	}
+	updateCacheGauge()
+}
+
+func keyFor(r *dns.Msg) cacheKey {
+	q := r.Question[0]
+	opt := r.IsEdns0()
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, do: opt != nil && opt.Do()}
+}
+
+// cacheLookup returns a copy of the cached answer for r, with its TTLs counted down, and
+// r's question and EDNS0 (not those of whoever asked first)
+func cacheLookup(r *dns.Msg) (*dns.Msg, bool) {
+	key := keyFor(r)
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if cacheConfig.Size <= 0 {
+		return nil, false
+	}
+	e, ok := cache[key]
+	if ok && time.Now().After(e.expires) {
+		removeEntry(e)
+		ok = false
+	}
+	if !ok {
+		cacheStats.Misses++
+		control.AddCounter("cirrid_dns_cache_lookups_total", "Forwarded queries answered from the cache (hit) or upstream (miss)", 1, "result", "miss")
+		updateCacheGauge()
+		return nil, false
+	}
+	cacheStats.Hits++
+	control.AddCounter("cirrid_dns_cache_lookups_total", "Forwarded queries answered from the cache (hit) or upstream (miss)", 1, "result", "hit")
+	e.hits++
+	cacheOrder.MoveToFront(e.element)
+
+	left := time.Until(e.expires)
+	if cacheConfig.Prefetch && !e.prefetching && e.hits >= prefetchHits && left < e.expires.Sub(e.stored)/prefetchFraction {
+		e.prefetching = true
+		go prefetch(r.Copy(), e.servers)
+	}
+
+	age := uint32(time.Since(e.stored).Seconds())
+	m := e.msg.Copy()
+	m.Question = append([]dns.Question{}, r.Question...)
+	setEdns0(m, r)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m, true
+}
+
+// setEdns0 swaps the OPT record in the cached answer m for one answering r's, or drops it if r
+// didn't have one (RFC 6891 section 6.1.1)
+func setEdns0(m, r *dns.Msg) {
+	size := uint16(dns.DefaultMsgSize)
+	extra := []dns.RR{}
+	for _, rr := range m.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			size = opt.UDPSize()
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(size, opt.Do())
+	}
+}
+
+func prefetch(r *dns.Msg, servers []string) {
+	resp, err := exchangeUpstream(r, servers)
+	cacheLock.Lock()
+	cacheStats.Prefetches++
+	cacheLock.Unlock()
+	control.AddCounter("cirrid_dns_cache_prefetches_total", "Popular answers fetched again before they expired", 1)
+	if err != nil {
+		// let it expire, the next miss will try again
+		return
+	}
+	cacheStore(r, resp, servers)
+}
+
+// cacheTTL is how long resp can be kept, false if it shouldn't be
+func cacheTTL(resp *dns.Msg, maxTTL time.Duration) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+	negative := resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0
+	if !negative && resp.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+
+	var ttl uint32
+	if negative {
+		// without an SOA there's no negative TTL, so it isn't kept (RFC 2308 section 5)
+		found := false
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				found = true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+		maxTTL = maxNegativeTTL
+	} else {
+		ttl = resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if ttl == 0 {
+		return 0, false
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > maxTTL {
+		d = maxTTL
+	}
+	return d, true
+}
+
+// cacheStore keeps upstream's answer to r, if it can be
+func cacheStore(r, resp *dns.Msg, servers []string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if cacheConfig.Size <= 0 {
+		return
+	}
+	ttl, ok := cacheTTL(resp, cacheConfig.MaxTTL)
+	if !ok {
+		return
+	}
+	key := keyFor(r)
+	if old, ok := cache[key]; ok {
+		removeEntry(old)
+	}
+	for len(cache) >= cacheConfig.Size {
+		evictOldest()
+	}
+	// nothing we hand out should outlive the entry (like the SOA of a negative answer, RFC 2308 section 5)
+	msg := resp.Copy()
+	limit := uint32(ttl / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > limit {
+				rr.Header().Ttl = limit
+			}
+		}
+	}
+	now := time.Now()
+	e := &cacheEntry{key: key, msg: msg, servers: servers, stored: now, expires: now.Add(ttl)}
+	e.element = cacheOrder.PushFront(e)
+	cache[key] = e
+	updateCacheGauge()
+}
+
+// must be called with cacheLock held
+func removeEntry(e *cacheEntry) {
+	cacheOrder.Remove(e.element)
+	delete(cache, e.key)
+}
+
+// must be called with cacheLock held
+func evictOldest() {
+	back := cacheOrder.Back()
+	if back == nil {
+		return
+	}
+	removeEntry(back.Value.(*cacheEntry))
+	cacheStats.Evictions++
+	control.AddCounter("cirrid_dns_cache_evictions_total", "Answers dropped from the full cache before they expired", 1)
+}
+
+// must be called with cacheLock held
+func updateCacheGauge() {
+	control.SetGauge("cirrid_dns_cache_entries", "Answers in the forwarding cache", float64(len(cache)))
+}
+
+// FlushCache drops every cached answer, returning how many there were
+func FlushCache() int {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	n := len(cache)
+	cache = map[cacheKey]*cacheEntry{}
+	cacheOrder.Init()
+	updateCacheGauge()
+	logger.Infof("Flushed %d answers from the DNS cache\n", n)
+	return n
+}
+
+// GetCacheStats returns the cache's size and counts
+func GetCacheStats() CacheStats {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	stats := cacheStats
+	stats.Size = cacheConfig.Size
+	stats.Entries = len(cache)
+	return stats
+}
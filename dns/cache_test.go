@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/kardianos/service"
+	"github.com/miekg/dns"
+)
+
+func cachedAnswer(t *testing.T, first *dns.Msg) {
+	SetLogger(service.ConsoleLogger)
+	FlushCache()
+	t.Cleanup(func() { FlushCache() })
+
+	resp := new(dns.Msg)
+	resp.SetReply(first)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: first.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{192, 0, 2, 1},
+	})
+	resp.SetEdns0(1232, false)
+	cacheStore(first, resp, []string{"192.0.2.53:53"})
+}
+
+// a cached answer is for whoever's asking now, not whoever asked first
+func TestCacheLookupAnswersTheQuestionAsked(t *testing.T) {
+	first := new(dns.Msg)
+	first.SetQuestion("WWW.Example.COM.", dns.TypeA)
+	first.SetEdns0(4096, false)
+	cachedAnswer(t, first)
+
+	// without EDNS0, there's no OPT in the answer
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	m, ok := cacheLookup(r)
+	if !ok {
+		t.Fatal("expected a hit")
+	}
+	if m.Question[0].Name != "www.example.com." {
+		t.Errorf("answered %q", m.Question[0].Name)
+	}
+	if m.IsEdns0() != nil {
+		t.Error("answered with an OPT record the query didn't have")
+	}
+
+	r.SetEdns0(1400, false)
+	m, ok = cacheLookup(r)
+	if !ok {
+		t.Fatal("expected a hit")
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		t.Fatal("no OPT record in the answer")
+	}
+	if opt.UDPSize() != 1232 {
+		t.Errorf("advertised %d, want upstream's 1232", opt.UDPSize())
+	}
+	opts := 0
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts != 1 {
+		t.Errorf("%d OPT records", opts)
+	}
+}
+
+// udpWriter is a memoryWriter for a plain DNS client over UDP
+type udpWriter struct {
+	memoryWriter
+}
+
+func (w *udpWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// a cached answer too big for a 512 byte datagram is only truncated for UDP clients,
+// DoH (and `cirrid query`) get all of it through Exchange
+func TestCachedReplyTruncation(t *testing.T) {
+	useStore(t)
+	SetUpstream([]string{"192.0.2.53"})
+	defer SetUpstream(nil)
+	t.Cleanup(func() { FlushCache() })
+
+	q := new(dns.Msg)
+	q.SetQuestion("big.example.org.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	for i := 1; i <= 40; i++ {
+		resp.Answer = append(resp.Answer, newA("big.example.org.", fmt.Sprintf("198.51.100.%d", i), 300))
+	}
+	cacheStore(q, resp, Upstream())
+	if packed, _ := resp.Pack(); len(packed) <= dns.MinMsgSize {
+		t.Fatalf("the answer is only %d bytes", len(packed))
+	}
+
+	reply := Exchange(q)
+	if reply.Truncated || len(reply.Answer) != 40 {
+		t.Errorf("through Exchange: truncated %v, %d answers", reply.Truncated, len(reply.Answer))
+	}
+
+	w := &udpWriter{}
+	(&handler{}).ServeDNS(w, q)
+	if !w.reply.Truncated || len(w.reply.Answer) >= 40 {
+		t.Errorf("over UDP: truncated %v, %d answers", w.reply.Truncated, len(w.reply.Answer))
+	}
+}
@@ -4,7 +4,7 @@ package dns
 
 import (
 	"bufio"
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -36,18 +36,10 @@ func EnsureResolveConfigured(logger service.Logger) error {
 	scanner.Split(bufio.ScanLines)
 	var text []string
 
-	// yeah, deduping, and using that to get a list of ~hosts
-	domainMap := make(map[string]bool)
 	domains := []string{}
-	for host, ip := range domainsToAddresses {
-		logger.Infof("host: %s -> %s", host, ip)
-		host = strings.TrimPrefix(host, "*.")
-		host = strings.TrimSuffix(host, ".")
-		host = strings.TrimPrefix(host, ".")
-		if _, ok := domainMap[host]; !ok {
-			domains = append(domains, "~"+host)
-		}
-		domainMap[host] = true
+	for _, host := range RoutingDomains() {
+		logger.Infof("routing domain: %s", host)
+		domains = append(domains, "~"+host)
 	}
 
 	// Big nasty assumption that resolved.conf only contains a [Resolve] section
@@ -107,27 +99,11 @@ func EnsureResolveConfigured(logger service.Logger) error {
 	return nil
 }
 
-func getIpAddress() string {
-	ipAddress := "172.17.0.1"
-	// get docker bridge's gateway address (linux only)
-	out, stderr, err := util.RunLocally(util.Options{}, "docker", "network", "inspect", "bridge")
-	//logger.Infof("%s\n", out)
-	logger.Infof("STDERR: %s\n", stderr)
-	if err != nil {
-		logger.Infof("ERROR: %s\n", err)
-		logger.Infof("using default IP: %s\n", ipAddress)
-	} else {
-		var result []interface{}
-		json.Unmarshal([]byte(out), &result)
-		cfg := result[0].(map[string]interface{})
-		IPAM := cfg["IPAM"].(map[string]interface{})
-		ConfigArr := IPAM["Config"].([]interface{})
-		Config := ConfigArr[0].(map[string]interface{})
-		Gateway := Config["Gateway"].(string)
-		ipAddress = Gateway
-		logger.Infof("using IP from docker bridge: (%s)\n", ipAddress)
-	}
-	return ipAddress
+var defaultMagicOrder = []string{"context", "bridge", "published", "route", "loopback"}
+
+// on linux all of 127/8 is on lo, so we can use the DNS server's address
+func loopbackAliasAddress() string {
+	return getDNSServerIPAddress()
 }
 
 func ResetHostServices(logger service.Logger) error {
@@ -161,3 +137,112 @@ func ResetHostServices(logger service.Logger) error {
 func getDNSServerIPAddress() string {
 	return "127.0.0.98"
 }
+
+// ownDomain is true for a Domains= entry cirrid would have written: a routing domain, a name in one of our zones,
+// or the reverse name of one address (published names come and go, so they may not all be known now)
+func ownDomain(domain string, routing map[string]bool) bool {
+	d := strings.ToLower(strings.Trim(strings.TrimPrefix(domain, "~"), "."))
+	if routing[d] {
+		return true
+	}
+	storeLock.RLock()
+	z := findZone(d)
+	storeLock.RUnlock()
+	if z != nil {
+		return true
+	}
+	labels := strings.Split(d, ".")
+	return strings.HasSuffix(d, ".in-addr.arpa") && len(labels) == 6 || strings.HasSuffix(d, ".ip6.arpa") && len(labels) == 34
+}
+
+// RevertResolveConfigured takes our DNS= line, and the domains we added, back out of resolved.conf
+// (keeping any Domains= the user has too), returning what it removed
+func RevertResolveConfigured(logger service.Logger) ([]string, error) {
+	resolvedConf := "/etc/systemd/resolved.conf"
+	contents, err := ioutil.ReadFile(resolvedConf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lines := strings.Split(string(contents), "\n")
+	ours := false
+	for _, line := range lines {
+		if line == "DNS="+getDNSServerIPAddress() {
+			ours = true
+		}
+	}
+	if !ours {
+		logger.Infof("%s isn't using cirrid\n", resolvedConf)
+		return nil, nil
+	}
+
+	routing := map[string]bool{}
+	for _, d := range RoutingDomains() {
+		routing[d] = true
+	}
+	removed := []string{}
+	text := []string{}
+	for _, line := range lines {
+		if line == "DNS="+getDNSServerIPAddress() {
+			removed = append(removed, fmt.Sprintf("%s: %s", resolvedConf, line))
+			continue
+		}
+		if strings.HasPrefix(line, "Domains=") {
+			kept := []string{}
+			for _, d := range strings.Fields(strings.TrimPrefix(line, "Domains=")) {
+				if ownDomain(d, routing) {
+					removed = append(removed, fmt.Sprintf("%s: Domains=%s", resolvedConf, d))
+				} else {
+					kept = append(kept, d)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			line = "Domains=" + strings.Join(kept, " ")
+		}
+		text = append(text, line)
+	}
+	if err := ioutil.WriteFile(resolvedConf, []byte(strings.Join(text, "\n")), 0644); err != nil {
+		return nil, err
+	}
+	// and make systemd-resolved forget about us
+	if err := ResetHostServices(logger); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// CheckResolveConfigured returns what's wrong with resolved.conf, for sending domains to us
+func CheckResolveConfigured(domains []string) []string {
+	resolvedConf := "/etc/systemd/resolved.conf"
+	contents, err := ioutil.ReadFile(resolvedConf)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	dnsline := "DNS=" + getDNSServerIPAddress()
+	configured := map[string]bool{}
+	hasDNS := false
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == dnsline {
+			hasDNS = true
+		}
+		if strings.HasPrefix(line, "Domains=") {
+			for _, d := range strings.Fields(strings.TrimPrefix(line, "Domains=")) {
+				configured[strings.TrimPrefix(d, "~")] = true
+			}
+		}
+	}
+	if !hasDNS {
+		problems = append(problems, fmt.Sprintf("%s has no %s line", resolvedConf, dnsline))
+	}
+	for _, d := range domains {
+		if !configured[d] {
+			problems = append(problems, fmt.Sprintf("%s Domains= doesn't include ~%s", resolvedConf, d))
+		}
+	}
+	return problems
+}
@@ -4,6 +4,7 @@ package dns
 
 import (
 	"bufio"
+	"fmt"
 	//"encoding/json"
 	"io/ioutil"
 	"os"
@@ -15,11 +16,8 @@ import (
 
 func EnsureResolveConfigured(logger service.Logger) error {
 	logger.Infof("EnsureResolveConfigured")
-	for host, ip := range domainsToAddresses {
-		logger.Infof("host: %s -> %s", host, ip)
-		host = strings.TrimPrefix(host, "*.")
-		host = strings.TrimSuffix(host, ".")
-		host = strings.TrimPrefix(host, ".")
+	for _, host := range RoutingDomains() {
+		logger.Infof("routing domain: %s", host)
 		createResolveFile(host)
 	}
 	return nil
@@ -30,7 +28,6 @@ func createResolveFile(host string) {
 	var text []string
 	requiredLine := "nameserver " + getDNSServerIPAddress()
 
-	// TODO: use the domainsToAddresses list
 	resolvedConf := "/etc/resolver/" + host
 	file, err := os.Open(resolvedConf)
 	if err != nil {
@@ -97,7 +94,7 @@ func ResetHostServices(logger service.Logger) error {
 	}
 
 	// sudo ifconfig lo0 alias 172.17.0.1
-	out, stderr, err = util.RunLocally(util.Options{}, "ifconfig", "lo0", "alias", getIpAddress())
+	out, stderr, err = util.RunLocally(util.Options{}, "ifconfig", "lo0", "alias", loopbackAliasAddress())
 	logger.Infof("%s\n", out)
 	logger.Infof("STDERR: %s\n", stderr)
 	if err != nil {
@@ -107,12 +104,75 @@ func ResetHostServices(logger service.Logger) error {
 	return nil
 }
 
+// Docker Desktop's bridge isn't reachable from the host, so prefer the lo0 alias
+var defaultMagicOrder = []string{"context", "published", "loopback"}
+
 // the virtual IP address to talk to the local cirri container
-func getIpAddress() string {
-	ipAddress := "172.17.0.1"
-	return ipAddress
+func loopbackAliasAddress() string {
+	return "172.17.0.1"
 }
 
 func getDNSServerIPAddress() string {
 	return "127.0.0.1"
 }
+
+// RevertResolveConfigured removes the /etc/resolver files that only point at us, and the lo0 alias, returning what it removed
+func RevertResolveConfigured(logger service.Logger) ([]string, error) {
+	removed := []string{}
+	files, err := ioutil.ReadDir("/etc/resolver")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	requiredLine := "nameserver " + getDNSServerIPAddress()
+	for _, f := range files {
+		resolvedConf := "/etc/resolver/" + f.Name()
+		contents, err := ioutil.ReadFile(resolvedConf)
+		if err != nil {
+			logger.Warningf("can't read %s: %s\n", resolvedConf, err)
+			continue
+		}
+		// leave files that have anything else in them alone
+		if strings.TrimSpace(string(contents)) != requiredLine {
+			continue
+		}
+		if err := os.Remove(resolvedConf); err != nil {
+			return removed, err
+		}
+		removed = append(removed, resolvedConf)
+	}
+
+	out, stderr, err := util.RunLocally(util.Options{}, "ifconfig", "lo0", "-alias", loopbackAliasAddress())
+	logger.Infof("%s\n", out)
+	logger.Infof("STDERR: %s\n", stderr)
+	if err != nil {
+		logger.Infof("ERROR: %s\n", err)
+	} else {
+		removed = append(removed, "lo0 alias "+loopbackAliasAddress())
+	}
+
+	if _, _, err := util.RunLocally(util.Options{}, "dscacheutil", "-flushcache"); err != nil {
+		logger.Infof("ERROR: %s\n", err)
+	}
+	if _, _, err := util.RunLocally(util.Options{}, "killall", "-HUP", "mDNSResponder"); err != nil {
+		logger.Infof("ERROR: %s\n", err)
+	}
+	return removed, nil
+}
+
+// CheckResolveConfigured returns what's wrong with the /etc/resolver files, for sending domains to us
+func CheckResolveConfigured(domains []string) []string {
+	problems := []string{}
+	requiredLine := "nameserver " + getDNSServerIPAddress()
+	for _, d := range domains {
+		resolvedConf := "/etc/resolver/" + d
+		contents, err := ioutil.ReadFile(resolvedConf)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if !strings.Contains(string(contents), requiredLine) {
+			problems = append(problems, fmt.Sprintf("%s has no %q line", resolvedConf, requiredLine))
+		}
+	}
+	return problems
+}
@@ -17,12 +17,21 @@ func ResetHostServices(logger service.Logger) error {
 	return nil
 }
 
+var defaultMagicOrder = []string{"context", "published", "loopback"}
+
 // the virtual IP address to talk to the local cirri container
-func getIpAddress() string {
-	ipAddress := "172.17.0.1"
-	return ipAddress
+func loopbackAliasAddress() string {
+	return "172.17.0.1"
 }
 
 func getDNSServerIPAddress() string {
 	return "127.0.0.1"
 }
+
+func RevertResolveConfigured(logger service.Logger) ([]string, error) {
+	return nil, nil
+}
+
+func CheckResolveConfigured(domains []string) []string {
+	return []string{"resolver configuration isn't implemented on windows yet"}
+}
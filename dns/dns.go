@@ -6,10 +6,14 @@ package dns
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/kardianos/service"
 	"github.com/miekg/dns"
@@ -19,44 +23,396 @@ import (
 // test using:
 //      dig @127.0.0.1 -p 9856 host.ona.im
 
-var domainsToAddresses map[string]string = map[string]string{
-	"host.ona.im.":  "104.198.14.52",
-	".host.ona.im.": "104.198.14.52", // wildcard
+// Zone holds the settings for one DNS zone we answer for
+type Zone struct {
+	Name        string
+	TTL         uint32
+	Wildcard    bool
+	UseHostname bool
+	AskCirri    bool
+	// upstream DNS servers to ask about names in the zone that we don't have
+	Forward []string
 }
 
-type handler struct{}
+const DefaultTTL = 60
+
+var storeLock sync.RWMutex
+var zones = map[string]*Zone{}
+var records = map[string][]dns.RR{
+	"host.ona.im.":   {newA("host.ona.im.", "104.198.14.52", DefaultTTL)},
+	"*.host.ona.im.": {newA("*.host.ona.im.", "104.198.14.52", DefaultTTL)},
+}
+
+// per name overrides of the zone's wildcard setting
+var wildcardOverrides = map[string]bool{}
+
+func newA(name, address string, ttl uint32) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(address).To4(),
+	}
+}
+
+// AddZone registers a zone, replacing any earlier settings for it
+func AddZone(z Zone) {
+	z.Name = strings.ToLower(strings.Trim(z.Name, "."))
+	if z.TTL == 0 {
+		z.TTL = DefaultTTL
+	}
+	for i, upstream := range z.Forward {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			z.Forward[i] = net.JoinHostPort(upstream, "53")
+		}
+	}
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	zones[z.Name] = &z
+}
+
+// Zones returns a copy of the registered zones, sorted by name
+func Zones() []Zone {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	list := make([]Zone, 0, len(zones))
+	for _, z := range zones {
+		list = append(list, *z)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// findZone returns the most specific zone that name is in, or nil
+// must be called with storeLock held
+func findZone(name string) *Zone {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var found *Zone
+	for zoneName, z := range zones {
+		if name == zoneName || strings.HasSuffix(name, "."+zoneName) {
+			if found == nil || len(zoneName) > len(found.Name) {
+				found = z
+			}
+		}
+	}
+	return found
+}
+
+// nameExists is true if there are records for name, or for any name below it (RFC 4592 empty non-terminals)
+// must be called with storeLock held
+func nameExists(name string) bool {
+	if _, ok := records[name]; ok {
+		return true
+	}
+	for owner := range records {
+		if strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func parentName(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 || i == len(name)-1 {
+		return ""
+	}
+	return name[i+1:]
+}
+
+// lookup finds the records for name. If there's no exact match, the wildcard
+// of the closest existing ancestor (the closest encloser in RFC 4592 terms) is used,
+// so *.host.ona.im matches a.b.host.ona.im, unless b.host.ona.im exists or has its own wildcard.
+// exists is false if the name doesn't exist at all (NXDOMAIN).
+// must be called with storeLock held
+func lookup(name string) (rrs []dns.RR, owner string, exists bool) {
+	if rrs, ok := records[name]; ok {
+		return rrs, name, true
+	}
+	if nameExists(name) {
+		return nil, name, true
+	}
+	for encloser := parentName(name); encloser != ""; encloser = parentName(encloser) {
+		if !nameExists(encloser) {
+			continue
+		}
+		wildcard := "*." + encloser
+		if rrs, ok := records[wildcard]; ok {
+			return rrs, wildcard, true
+		}
+		return nil, "", false
+	}
+	return nil, "", false
+}
+
+// how many CNAMEs we'll follow within our own records
+const maxCNAMEChain = 8
+
+// synthesize copies rr, giving it the name asked for (it may have come from a wildcard)
+func synthesize(rr dns.RR, name string) dns.RR {
+	answer := dns.Copy(rr)
+	answer.Header().Name = name
+	return answer
+}
+
+// answerFor adds the records for name/qtype to msg, following CNAMEs through our own records.
+// exists is false if name doesn't exist at all.
+// must be called with storeLock held
+func answerFor(msg *dns.Msg, name string, qtype uint16) (exists bool) {
+	seen := map[string]bool{}
+	for hops := 0; hops < maxCNAMEChain; hops++ {
+		rrs, _, found := lookup(strings.ToLower(name))
+		if hops == 0 {
+			exists = found
+		}
+		if !found {
+			return exists
+		}
+		seen[strings.ToLower(name)] = true
+
+		matched := false
+		var cname dns.RR
+		for _, rr := range rrs {
+			if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+				msg.Answer = append(msg.Answer, synthesize(rr, name))
+				matched = true
+			} else if rr.Header().Rrtype == dns.TypeCNAME {
+				cname = rr
+			}
+		}
+		if matched || cname == nil {
+			return exists
+		}
+		msg.Answer = append(msg.Answer, synthesize(cname, name))
+		name = cname.(*dns.CNAME).Target
+		if seen[strings.ToLower(name)] {
+			logger.Warningf("CNAME loop at %s\n", name)
+			return exists
+		}
+	}
+	return exists
+}
+
+// addGlue adds the addresses we know for the targets of NS, MX and SRV answers to the additional section
+// must be called with storeLock held
+func addGlue(msg *dns.Msg) {
+	done := map[string]bool{}
+	for _, rr := range msg.Answer {
+		target := ""
+		switch v := rr.(type) {
+		case *dns.NS:
+			target = v.Ns
+		case *dns.MX:
+			target = v.Mx
+		case *dns.SRV:
+			target = v.Target
+		}
+		if target == "" || done[strings.ToLower(target)] {
+			continue
+		}
+		done[strings.ToLower(target)] = true
+		rrs, _, _ := lookup(strings.ToLower(target))
+		for _, glue := range rrs {
+			if t := glue.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				msg.Extra = append(msg.Extra, synthesize(glue, target))
+			}
+		}
+	}
+}
+
+func isReverseName(name string) bool {
+	return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
+
+// addressOf returns the IP of an A or AAAA record, or nil
+func addressOf(rr dns.RR) net.IP {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A
+	case *dns.AAAA:
+		return v.AAAA
+	}
+	return nil
+}
+
+// reverseRecords synthesizes PTR records for a reverse name (eg 1.0.17.172.in-addr.arpa.) from our A and AAAA records.
+// Explicitly named hosts are preferred, we only fall back to the names of wildcards (without the '*.') if there aren't any.
+// must be called with storeLock held
+func reverseRecords(name string) []dns.RR {
+	named := map[string]uint32{}
+	wildcards := map[string]uint32{}
+	for owner, rrs := range records {
+		for _, rr := range rrs {
+			ip := addressOf(rr)
+			if ip == nil {
+				continue
+			}
+			reverse, err := dns.ReverseAddr(ip.String())
+			if err != nil || reverse != name {
+				continue
+			}
+			if strings.HasPrefix(owner, "*.") {
+				wildcards[strings.TrimPrefix(owner, "*.")] = rr.Header().Ttl
+			} else {
+				named[owner] = rr.Header().Ttl
+			}
+		}
+	}
+	if len(named) == 0 {
+		named = wildcards
+	}
+	targets := make([]string, 0, len(named))
+	for target := range named {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	ptrs := []dns.RR{}
+	for _, target := range targets {
+		ptrs = append(ptrs, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: named[target]},
+			Ptr: target,
+		})
+	}
+	return ptrs
+}
+
+// reverseNames are the reverse (PTR) names of every address in our records
+// must be called with storeLock held
+func reverseNames() []string {
+	names := []string{}
+	for _, rrs := range records {
+		for _, rr := range rrs {
+			if ip := addressOf(rr); ip != nil {
+				if reverse, err := dns.ReverseAddr(ip.String()); err == nil {
+					names = append(names, reverse)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// claims is true if name is at or below one of the names we route to ourselves (see RoutingDomains),
+// so if we don't have it, it doesn't exist. Zones with forwarders are left out, their names are forwarded.
+// must be called with storeLock held
+func claims(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	under := func(owner string) bool {
+		owner = strings.TrimSuffix(strings.TrimPrefix(owner, "*."), ".")
+		return name == owner || strings.HasSuffix(name, "."+owner)
+	}
+	for owner := range records {
+		if under(owner) {
+			return true
+		}
+	}
+	for _, reverse := range reverseNames() {
+		if under(reverse) {
+			return true
+		}
+	}
+	return false
+}
+
+type handler struct {
+	// only answer from our own records, never asking upstream (for the control api)
+	localOnly bool
+}
 
 func (this *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	msg := dns.Msg{}
 	msg.SetReply(r)
-	switch r.Question[0].Qtype {
-	case dns.TypeA:
-		msg.Authoritative = true
-		domain := msg.Question[0].Name
-		address, ok := domainsToAddresses[domain]
-		if !ok {
-			firstDot := strings.Index(domain, ".")
-			domainSuffix := domain[firstDot:]
-			address, ok = domainsToAddresses[domainSuffix]
-		}
-		if ok {
-			logger.Infof("DNS request for %s answered with %s\n", domain, address)
-
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   net.ParseIP(address),
-			})
-		} else {
-			// TODO: is there a notMe answer?
-			//if strings.HasSuffix(domain, "ona.im.") {
-			if strings.Contains(domain, "ona.im") {
-				logger.Infof("DNS request for (%s) failed\n", domain)
+	question := msg.Question[0]
+	domain := strings.ToLower(question.Name)
+
+	storeLock.RLock()
+	zone := findZone(domain)
+	exists := answerFor(&msg, question.Name, question.Qtype)
+	if !exists && isReverseName(domain) {
+		ptrs := reverseRecords(domain)
+		exists = len(ptrs) > 0
+		if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+			msg.Answer = append(msg.Answer, ptrs...)
+		}
+	}
+	addGlue(&msg)
+	claimed := claims(domain)
+	storeLock.RUnlock()
+	if exists && !claimed {
+		// only an empty non-terminal above our names (like the zone apex), which the rest of the world answers for
+		exists = false
+	}
+
+	if !exists {
+		if !this.localOnly {
+			if zone != nil && len(zone.Forward) > 0 {
+				forward(w, r, zone.Forward)
+				return
 			}
+			// the host resolver only sends us the names we claim, but clients that send everything (eg DoH)
+			// also ask about the rest of our zones (like www.ona.im, or ona.im itself), and the rest of the world
+			if upstream := Upstream(); !claimed && len(upstream) > 0 {
+				forward(w, r, upstream)
+				return
+			}
+		}
+		if claimed {
+			logger.Infof("DNS request for (%s) failed\n", domain)
+			msg.Authoritative = true
+			msg.Rcode = dns.RcodeNameError
+		} else {
+			msg.Rcode = dns.RcodeRefused
 		}
+		w.WriteMsg(&msg)
+		return
 	}
+
+	msg.Authoritative = true
+	logger.Infof("DNS request for %s %s answered with %d records\n", domain, dns.TypeToString[question.Qtype], len(msg.Answer))
 	w.WriteMsg(&msg)
 }
 
+// forward answers from the cache, or asks the upstream servers and relays the first answer we get
+func forward(w dns.ResponseWriter, r *dns.Msg, servers []string) {
+	if resp, ok := cacheLookup(r); ok {
+		resp.Id = r.Id
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			// it may have been fetched for someone with a bigger buffer
+			size := dns.MinMsgSize
+			if opt := r.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+			}
+			resp.Truncate(size)
+		}
+		w.WriteMsg(resp)
+		return
+	}
+	resp, err := exchangeUpstream(r, servers)
+	if err != nil {
+		msg := dns.Msg{}
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(&msg)
+		return
+	}
+	cacheStore(r, resp, servers)
+	resp.Id = r.Id
+	w.WriteMsg(resp)
+}
+
+// exchangeUpstream asks each of the servers in turn, until one answers
+func exchangeUpstream(r *dns.Msg, servers []string) (*dns.Msg, error) {
+	c := new(dns.Client)
+	err := fmt.Errorf("no servers to forward to")
+	for _, upstream := range servers {
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(r, upstream)
+		if err != nil {
+			logger.Infof("Forwarding %s to %s failed: %s\n", r.Question[0].Name, upstream, err)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
 var port = 53
 var logger service.Logger
 
@@ -64,47 +420,193 @@ func SetLogger(l service.Logger) {
 	logger = l
 }
 
-func SetDNSValue(hostname, zone, ipAddress string) error {
+// fullName works out the fully qualified name for a hostname from the cfg file:
+// names without a dot are in zone, and '*.name' or the older '.name' are wildcards
+func fullName(hostname, zone string) string {
 	// TODO: maybe there's a dns name string manipulation module
+	wildcard := ""
+	if strings.HasPrefix(hostname, "*.") {
+		hostname = strings.TrimPrefix(hostname, "*.")
+		wildcard = "*."
+	} else if strings.HasPrefix(hostname, ".") {
+		hostname = strings.TrimPrefix(hostname, ".")
+		wildcard = "*."
+	}
 	fullname := hostname
-	if !strings.Contains(strings.TrimPrefix(hostname, "."), ".") {
-		if !strings.HasPrefix(zone, ".") {
-			zone = "." + zone
-		}
-		fullname = hostname + zone
+	if !strings.Contains(hostname, ".") {
+		fullname = hostname + "." + strings.Trim(zone, ".")
 	}
+	return strings.ToLower(dns.Fqdn(wildcard + fullname))
+}
+
+func SetDNSValue(hostname, zone, ipAddress string) error {
+	fullname := fullName(hostname, zone)
 
-	if ipAddress == "magic" {
-		ipAddress = getIpAddress()
+	isMagic := ipAddress == "magic"
+	if isMagic {
+		ipAddress = GetMagic().Address
+	}
+	if ip := net.ParseIP(ipAddress); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("%s: %q is not an IPv4 address", fullname, ipAddress)
 	}
 
-	domainsToAddresses[fullname+"."] = ipAddress
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	ttl := uint32(DefaultTTL)
+	if z := findZone(fullname); z != nil {
+		ttl = z.TTL
+	}
+	kept := []dns.RR{}
+	for _, rr := range records[fullname] {
+		if rr.Header().Rrtype != dns.TypeA {
+			kept = append(kept, rr)
+		}
+	}
+	records[fullname] = append(kept, newA(fullname, ipAddress, ttl))
+	if isMagic {
+		magicNames[fullname] = true
+	} else {
+		delete(magicNames, fullname)
+	}
 
 	return nil
 }
 
+// AddRecord adds a record written in zone file syntax, eg AddRecord("ona.im", "www.host", "CNAME host").
+// Names are relative to the zone unless they end in '.', and '@' is the zone itself.
+func AddRecord(zone, name, data string) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	origin := dns.Fqdn(zone)
+	ttl := uint32(DefaultTTL)
+	if z := findZone(origin); z != nil {
+		ttl = z.TTL
+	}
+	line := fmt.Sprintf("%s %d IN %s", name, ttl, data)
+	zp := dns.NewZoneParser(strings.NewReader(line), origin, "")
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no record in %q", line)
+	}
+	owner := strings.ToLower(rr.Header().Name)
+	rr.Header().Name = owner
+	if rr.Header().Rrtype == dns.TypeCNAME && len(records[owner]) > 0 {
+		logger.Warningf("%s has a CNAME and other records, the CNAME will only be used for other types\n", owner)
+	}
+	records[owner] = append(records[owner], rr)
+	return nil
+}
+
+// SetWildcard overrides the zone's wildcard setting for one name
+func SetWildcard(hostname, zone string, enabled bool) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	wildcardOverrides[fullName(hostname, zone)] = enabled
+}
+
+// EnsureWildCards adds *.name records for every name that wants them (as set by its zone, or SetWildcard),
+// unless there's already an explicit wildcard for it
 func EnsureWildCards() {
-	for host, ip := range domainsToAddresses {
-		if strings.HasPrefix(host, ".") {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	for host, rrs := range records {
+		if strings.HasPrefix(host, "*.") {
 			continue
 		}
-		done := false
-		for h, _ := range domainsToAddresses {
-			if h == "."+host {
-				done = true
-				break
+		wanted := true
+		if z := findZone(host); z != nil {
+			wanted = z.Wildcard
+		}
+		if enabled, ok := wildcardOverrides[host]; ok {
+			wanted = enabled
+		}
+		if !wanted {
+			continue
+		}
+		if _, done := records["*."+host]; !done {
+			// only the address-ish records are wildcarded, not the host's MX, TXT etc
+			wildcards := []dns.RR{}
+			for _, rr := range rrs {
+				switch rr.Header().Rrtype {
+				case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+					wildcards = append(wildcards, synthesize(rr, "*."+host))
+				}
+			}
+			if len(wildcards) > 0 {
+				records["*."+host] = wildcards
 			}
 		}
-		if !done {
-			domainsToAddresses["."+host] = ip
+	}
+}
+
+// RoutingDomains are the domains the host resolver should send to us.
+// Zones with upstream forwarders are ours entirely, otherwise we only claim the names we have,
+// and the reverse (PTR) names of their addresses.
+func RoutingDomains() []string {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	domainMap := make(map[string]bool)
+	for name, z := range zones {
+		if len(z.Forward) > 0 {
+			domainMap[name] = true
+		}
+	}
+	for host := range records {
+		host = strings.TrimPrefix(host, "*.")
+		host = strings.TrimSuffix(host, ".")
+		if z := findZone(host); z != nil && len(z.Forward) > 0 {
+			continue
 		}
+		domainMap[host] = true
 	}
+	for _, reverse := range reverseNames() {
+		domainMap[strings.TrimSuffix(reverse, ".")] = true
+	}
+	domains := make([]string, 0, len(domainMap))
+	for d := range domainMap {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// serialises writing the host resolver's settings and restarting it - startup, docker context
+// changes and remote hosts all do that, and a restart mustn't pick up a half written file
+var resolverLock sync.Mutex
+
+// WithResolverLock runs f holding the lock that serialises host resolver changes
+func WithResolverLock(f func()) {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+	f()
+}
+
+// UpdateRouting runs change (which publishes or removes names), and when that changes the routing domains,
+// rewrites the host resolver's settings and restarts it, so it sends the new domains to us
+func UpdateRouting(logger service.Logger, change func() error) error {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+	before := RoutingDomains()
+	err := change()
+	if !reflect.DeepEqual(before, RoutingDomains()) {
+		EnsureResolveConfigured(logger)
+		ResetHostServices(logger)
+	}
+	return err
+}
+
+// ServerAddress is the address:port the DNS server listens on
+func ServerAddress() string {
+	return net.JoinHostPort(getDNSServerIPAddress(), strconv.Itoa(port))
 }
 
 func DnsServer(l service.Logger) {
 	logger = l
 
-	srv := &dns.Server{Addr: getDNSServerIPAddress() + ":" + strconv.Itoa(port), Net: "udp"}
+	srv := &dns.Server{Addr: ServerAddress(), Net: "udp"}
 	srv.Handler = &handler{}
 	logger.Infof("DNS listening on IP %s\n", srv.Addr)
 	if err := srv.ListenAndServe(); err != nil {
@@ -123,30 +625,68 @@ func GetHostname() string {
 }
 
 func GetCirriStackdomain() string {
-	stackdomain := ""
 	// get docker bridge's gateway address (linux only)
-	out, stderr, err := util.RunLocally(util.Options{}, "docker", "inspect", "cirri")
+	out, stderr, err := util.RunDocker(util.Options{}, "inspect", "cirri")
 	//logger.Infof("%s\n", out)
 	logger.Infof("STDERR: %s\n", stderr)
 	if err != nil {
 		logger.Infof("ERROR: %s\n", err)
-		return stackdomain
-	} else {
-		var result []interface{}
-		json.Unmarshal([]byte(out), &result)
-		cfg := result[0].(map[string]interface{})
-		Config := cfg["Config"].(map[string]interface{})
-		Env := Config["Env"].([]interface{})
-
-		stackdomainPrefix := "STACKDOMAIN="
-		for _, r := range Env {
-			e := r.(string)
-			if strings.HasPrefix(e, stackdomainPrefix) {
-				stackdomain = strings.TrimPrefix(e, stackdomainPrefix)
-			}
+		return ""
+	}
+	stackdomain, err := ParseStackdomain(out)
+	if err != nil {
+		logger.Infof("ERROR: %s\n", err)
+		return ""
+	}
+	logger.Infof("found stackdomain from cirri: (%s)\n", stackdomain)
+	return stackdomain
+}
+
+// ParseStackdomain gets the STACKDOMAIN env setting out of `docker inspect cirri` output
+func ParseStackdomain(inspect string) (string, error) {
+	var result []struct {
+		Config struct {
+			Env []string
 		}
+	}
+	if err := json.Unmarshal([]byte(inspect), &result); err != nil {
+		return "", err
+	}
+	if len(result) == 0 {
+		return "", fmt.Errorf("no cirri container")
+	}
+	stackdomainPrefix := "STACKDOMAIN="
+	stackdomain := ""
+	for _, e := range result[0].Config.Env {
+		if strings.HasPrefix(e, stackdomainPrefix) {
+			stackdomain = strings.TrimPrefix(e, stackdomainPrefix)
+		}
+	}
+	return stackdomain, nil
+}
 
-		logger.Infof("found stackdomain from cirri: (%s)\n", stackdomain)
+// Known is true if name is in one of our zones, and we'd answer for it (possibly from a wildcard)
+func Known(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	if findZone(name) == nil {
+		return false
 	}
-	return stackdomain
+	_, _, exists := lookup(name)
+	return exists && claims(name)
+}
+
+// Records returns the records we're answering with, sorted by name
+func Records() []string {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	list := []string{}
+	for _, rrs := range records {
+		for _, rr := range rrs {
+			list = append(list, rr.String())
+		}
+	}
+	sort.Strings(list)
+	return list
 }
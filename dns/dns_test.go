@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kardianos/service"
+	"github.com/miekg/dns"
+)
+
+// useStore swaps in an empty store with the ona.im and dev.test zones for the length of a test,
+// then adds lines ("name TYPE data", relative to ona.im as for AddRecord)
+func useStore(t *testing.T, lines ...string) {
+	SetLogger(service.ConsoleLogger)
+	storeLock.Lock()
+	oldZones, oldRecords, oldOverrides, oldPublished := zones, records, wildcardOverrides, publishedBy
+	zones = map[string]*Zone{}
+	records = map[string][]dns.RR{}
+	wildcardOverrides = map[string]bool{}
+	publishedBy = map[string][]string{}
+	storeLock.Unlock()
+	t.Cleanup(func() {
+		storeLock.Lock()
+		defer storeLock.Unlock()
+		zones, records, wildcardOverrides, publishedBy = oldZones, oldRecords, oldOverrides, oldPublished
+	})
+
+	AddZone(Zone{Name: "ona.im"})
+	AddZone(Zone{Name: "dev.test"})
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		if err := AddRecord("ona.im", fields[0], fields[1]); err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+	}
+}
+
+// brief is "name TYPE data", without the TTL and class
+func brief(rrs []dns.RR) []string {
+	list := []string{}
+	for _, rr := range rrs {
+		fields := strings.Fields(rr.String())
+		list = append(list, fields[0]+" "+strings.Join(fields[3:], " "))
+	}
+	return list
+}
+
+func ask(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return Exchange(r)
+}
+
+type answerTest struct {
+	name   string
+	qname  string
+	qtype  uint16
+	rcode  int
+	answer []string
+	extra  []string
+}
+
+func checkAnswers(t *testing.T, tests []answerTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := ask(tt.qname, tt.qtype)
+			if reply.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := brief(reply.Answer); strings.Join(got, "\n") != strings.Join(tt.answer, "\n") {
+				t.Errorf("answer %q, want %q", got, tt.answer)
+			}
+			if got := brief(reply.Extra); strings.Join(got, "\n") != strings.Join(tt.extra, "\n") {
+				t.Errorf("extra %q, want %q", got, tt.extra)
+			}
+		})
+	}
+}
+
+func TestWildcardsAndCNAMEs(t *testing.T) {
+	useStore(t,
+		"host A 192.0.2.1",
+		"*.host A 192.0.2.1",
+		// b.host exists, so *.host doesn't cover names below it
+		"b.host TXT hello",
+		// an empty non-terminal (ent.host) blocks the wildcard too
+		"x.ent.host A 192.0.2.2",
+		"loop1 CNAME loop2",
+		"loop2 CNAME loop1",
+		"www CNAME app.dev.test.",
+		"app.dev.test. A 192.0.2.7",
+		"ext CNAME example.org.",
+		"@ MX 10 mail",
+		"@ NS ns1",
+		"mail A 192.0.2.25",
+		"ns1 A 192.0.2.53",
+	)
+	checkAnswers(t, []answerTest{
+		{name: "exact", qname: "host.ona.im.", qtype: dns.TypeA,
+			answer: []string{"host.ona.im. A 192.0.2.1"}},
+		{name: "wildcard", qname: "a.b2.host.ona.im.", qtype: dns.TypeA,
+			answer: []string{"a.b2.host.ona.im. A 192.0.2.1"}},
+		{name: "existing name has no A", qname: "b.host.ona.im.", qtype: dns.TypeA},
+		{name: "wildcard shadowed by an existing name", qname: "c.b.host.ona.im.", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError},
+		{name: "empty non-terminal", qname: "ent.host.ona.im.", qtype: dns.TypeA},
+		{name: "wildcard blocked by an empty non-terminal", qname: "y.ent.host.ona.im.", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError},
+		{name: "no such name", qname: "nope.ona.im.", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError},
+		{name: "CNAME loop", qname: "loop1.ona.im.", qtype: dns.TypeA,
+			answer: []string{"loop1.ona.im. CNAME loop2.ona.im.", "loop2.ona.im. CNAME loop1.ona.im."}},
+		{name: "CNAME into another zone", qname: "www.ona.im.", qtype: dns.TypeA,
+			answer: []string{"www.ona.im. CNAME app.dev.test.", "app.dev.test. A 192.0.2.7"}},
+		{name: "CNAME to a name that isn't ours", qname: "ext.ona.im.", qtype: dns.TypeA,
+			answer: []string{"ext.ona.im. CNAME example.org."}},
+		{name: "MX glue", qname: "ona.im.", qtype: dns.TypeMX,
+			answer: []string{"ona.im. MX 10 mail.ona.im."}, extra: []string{"mail.ona.im. A 192.0.2.25"}},
+		{name: "NS glue", qname: "ona.im.", qtype: dns.TypeNS,
+			answer: []string{"ona.im. NS ns1.ona.im."}, extra: []string{"ns1.ona.im. A 192.0.2.53"}},
+	})
+}
+
+func TestReverseRecords(t *testing.T) {
+	useStore(t,
+		"host A 192.0.2.1",
+		"*.host A 192.0.2.1",
+		"*.apps A 192.0.2.1",
+		"*.wild A 192.0.2.9",
+	)
+	checkAnswers(t, []answerTest{
+		{name: "named hosts win over wildcard owners", qname: "1.2.0.192.in-addr.arpa.", qtype: dns.TypePTR,
+			answer: []string{"1.2.0.192.in-addr.arpa. PTR host.ona.im."}},
+		{name: "only wildcards", qname: "9.2.0.192.in-addr.arpa.", qtype: dns.TypePTR,
+			answer: []string{"9.2.0.192.in-addr.arpa. PTR wild.ona.im."}},
+		// without upstream servers to ask
+		{name: "not our address", qname: "8.2.0.192.in-addr.arpa.", qtype: dns.TypePTR,
+			rcode: dns.RcodeRefused},
+	})
+}
+
+// names a source stops publishing take their PTRs (and reverse routing) with them
+func TestRemovedNameDropsPTR(t *testing.T) {
+	useStore(t)
+	if err := Publish("remote", "ona.im", []Host{{Name: "beefy", Address: "192.0.2.5"}}); err != nil {
+		t.Fatal(err)
+	}
+	reverse := "5.2.0.192.in-addr.arpa."
+	if got := brief(ask(reverse, dns.TypePTR).Answer); len(got) != 1 || got[0] != reverse+" PTR beefy.ona.im." {
+		t.Fatalf("published: %q", got)
+	}
+	if err := Publish("remote", "ona.im", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := brief(ask(reverse, dns.TypePTR).Answer); len(got) != 0 {
+		t.Errorf("removed: %q", got)
+	}
+	for _, d := range RoutingDomains() {
+		if d == strings.TrimSuffix(reverse, ".") {
+			t.Errorf("still routing %s", d)
+		}
+	}
+}
+
+// Query (the control api's /query) only answers from our records, so can't be used to fill the cache
+func TestQueryIsLocalOnly(t *testing.T) {
+	useStore(t, "host A 192.0.2.1")
+	SetUpstream([]string{"192.0.2.53"})
+	defer SetUpstream(nil)
+	before := GetCacheStats()
+
+	for name, want := range map[string]string{
+		"host.ona.im":      "NOERROR",
+		"nope.host.ona.im": "NXDOMAIN",
+		"www.ona.im":       "REFUSED",
+		"example.org.":     "REFUSED",
+	} {
+		result, err := Query(name, "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Rcode != want {
+			t.Errorf("%s: %s, want %s", name, result.Rcode, want)
+		}
+	}
+	if after := GetCacheStats(); after.Misses != before.Misses || after.Entries != before.Entries {
+		t.Errorf("the cache was used: %+v", after)
+	}
+}
+
+// fakeUpstream answers every A query with 198.51.100.80, until the test ends
+func fakeUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, newA(r.Question[0].Name, "198.51.100.80", 60))
+		w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		srv.Shutdown()
+		FlushCache()
+	})
+	return pc.LocalAddr().String()
+}
+
+// names in our zones that we don't claim (so the host resolver asks the world about them)
+// are forwarded for DoH and DoT clients too, only names below our own get NXDOMAIN
+func TestServeDNSForwardsUnclaimedNames(t *testing.T) {
+	useStore(t, "host A 192.0.2.1")
+	SetUpstream([]string{fakeUpstream(t)})
+	defer SetUpstream(nil)
+
+	checkAnswers(t, []answerTest{
+		{name: "ours", qname: "host.ona.im.", qtype: dns.TypeA,
+			answer: []string{"host.ona.im. A 192.0.2.1"}},
+		{name: "in our zone", qname: "www.ona.im.", qtype: dns.TypeA,
+			answer: []string{"www.ona.im. A 198.51.100.80"}},
+		{name: "the zone apex", qname: "ona.im.", qtype: dns.TypeA,
+			answer: []string{"ona.im. A 198.51.100.80"}},
+		{name: "outside our zones", qname: "example.org.", qtype: dns.TypeA,
+			answer: []string{"example.org. A 198.51.100.80"}},
+		{name: "below a name we claim", qname: "nope.host.ona.im.", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError},
+	})
+	if reply := ask("www.ona.im.", dns.TypeA); reply.Authoritative {
+		t.Error("forwarded answers aren't authoritative")
+	}
+}
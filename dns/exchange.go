@@ -0,0 +1,109 @@
+package dns
+
+// answer queries in-process, through the same handler the DNS listener uses,
+// so the control api can show what cirrid would say without going over the network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// memoryWriter is a dns.ResponseWriter that just keeps the reply
+type memoryWriter struct {
+	reply *dns.Msg
+}
+
+func (w *memoryWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(getDNSServerIPAddress()), Port: port}
+}
+// not UDP, as the reply never goes in a datagram - forward mustn't truncate it to fit one
+// (DoH clients can't retry over TCP)
+func (w *memoryWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+func (w *memoryWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+func (w *memoryWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.reply = m
+	return len(b), nil
+}
+func (w *memoryWriter) Close() error        { return nil }
+func (w *memoryWriter) TsigStatus() error   { return nil }
+func (w *memoryWriter) TsigTimersOnly(bool) {}
+func (w *memoryWriter) Hijack()             {}
+
+// Exchange answers r the same way the DNS server would (including forwarding)
+func Exchange(r *dns.Msg) *dns.Msg {
+	return exchange(&handler{}, r)
+}
+
+// ExchangeLocal answers r from our own records only, names we'd forward are REFUSED
+func ExchangeLocal(r *dns.Msg) *dns.Msg {
+	return exchange(&handler{localOnly: true}, r)
+}
+
+func exchange(h *handler, r *dns.Msg) *dns.Msg {
+	w := &memoryWriter{}
+	h.ServeDNS(w, r)
+	if w.reply == nil {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		return msg
+	}
+	return w.reply
+}
+
+// QueryResult is an answer from Query, as text
+type QueryResult struct {
+	Name          string
+	Type          string
+	Rcode         string
+	Authoritative bool
+	Answer        []string
+	Extra         []string
+}
+
+// Query asks cirrid's DNS handler for name (and qtype, eg "A", "MX", "PTR"; default A),
+// only from our own records - anyone can ask, so it mustn't send lookups upstream or fill the cache
+func Query(name, qtype string) (QueryResult, error) {
+	if qtype == "" {
+		qtype = "A"
+	}
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return QueryResult{}, fmt.Errorf("unknown record type %q", qtype)
+	}
+	if net.ParseIP(name) != nil {
+		// asking about an address means its PTR
+		t = dns.TypePTR
+		name, _ = dns.ReverseAddr(name)
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), t)
+	reply := ExchangeLocal(r)
+
+	result := QueryResult{
+		Name:          r.Question[0].Name,
+		Type:          dns.TypeToString[t],
+		Rcode:         dns.RcodeToString[reply.Rcode],
+		Authoritative: reply.Authoritative,
+		Answer:        []string{},
+		Extra:         []string{},
+	}
+	for _, rr := range reply.Answer {
+		result.Answer = append(result.Answer, rr.String())
+	}
+	for _, rr := range reply.Extra {
+		result.Extra = append(result.Extra, rr.String())
+	}
+	return result, nil
+}
@@ -0,0 +1,258 @@
+package dns
+
+// work out what IP address the 'magic' value should resolve to.
+// Each strategy is tried in order, and the first one that gives us a usable
+// address wins - we record which one, and why the others didn't, so `cirrid status`
+// can explain it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// MagicAttempt is the result of trying one strategy
+type MagicAttempt struct {
+	Strategy string
+	Address  string `json:",omitempty"`
+	Result   string
+}
+
+// MagicStatus records which strategy won, and why
+type MagicStatus struct {
+	Address  string
+	Strategy string
+	Reason   string
+	Attempts []MagicAttempt
+}
+
+type magicStrategy func(arg string) (address, reason string, err error)
+
+var magicStrategies = map[string]magicStrategy{
+	"context":   dockerContextAddress,
+	"bridge":    bridgeGatewayAddress,
+	"network":   dockerNetworkAddress,
+	"published": publishedPortAddress,
+	"route":     defaultRouteAddress,
+	"loopback":  loopbackAddress,
+}
+
+var magicOrder = defaultMagicOrder
+var magicLock sync.Mutex
+var magic *MagicStatus
+
+// the names set to 'magic', so RefreshMagic can move them
+var magicNames = map[string]bool{}
+
+// SetMagicOrder sets the strategies tried to find the 'magic' address,
+// eg "bridge, network:cirri, published, route, loopback"
+func SetMagicOrder(order string) error {
+	strategies := []string{}
+	for _, s := range strings.Split(order, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name := strings.SplitN(s, ":", 2)[0]
+		if _, ok := magicStrategies[name]; !ok {
+			return fmt.Errorf("unknown magic strategy %q", s)
+		}
+		strategies = append(strategies, s)
+	}
+	if len(strategies) == 0 {
+		return fmt.Errorf("no magic strategies in %q", order)
+	}
+	magicLock.Lock()
+	defer magicLock.Unlock()
+	magicOrder = strategies
+	magic = nil
+	return nil
+}
+
+// GetMagic returns the 'magic' address, working it out the first time its asked for
+func GetMagic() MagicStatus {
+	magicLock.Lock()
+	defer magicLock.Unlock()
+	if magic == nil {
+		status := findMagic(magicOrder)
+		magic = &status
+	}
+	return *magic
+}
+
+// RefreshMagic works the 'magic' address out again (eg when the docker context changed),
+// and moves the names that were set to it
+func RefreshMagic() MagicStatus {
+	magicLock.Lock()
+	old := magic
+	magic = nil
+	magicLock.Unlock()
+
+	status := GetMagic()
+	if old == nil || old.Address == status.Address {
+		return status
+	}
+	logger.Infof("magic IP moved from %s to %s\n", old.Address, status.Address)
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	for owner := range magicNames {
+		for _, name := range []string{owner, "*." + owner} {
+			for _, rr := range records[name] {
+				if a, ok := rr.(*dns.A); ok && a.A.String() == old.Address {
+					a.A = net.ParseIP(status.Address).To4()
+				}
+			}
+		}
+	}
+	return status
+}
+
+func findMagic(order []string) MagicStatus {
+	status := MagicStatus{}
+	for _, s := range order {
+		parts := strings.SplitN(s, ":", 2)
+		arg := ""
+		if len(parts) > 1 {
+			arg = parts[1]
+		}
+		address, reason, err := magicStrategies[parts[0]](arg)
+		if err == nil && parts[0] != "loopback" && parts[0] != "context" {
+			err = checkLocalAddress(address)
+		}
+		if err != nil {
+			logger.Infof("magic strategy %s: %s\n", s, err)
+			status.Attempts = append(status.Attempts, MagicAttempt{Strategy: s, Address: address, Result: err.Error()})
+			continue
+		}
+		status.Attempts = append(status.Attempts, MagicAttempt{Strategy: s, Address: address, Result: "ok"})
+		status.Address = address
+		status.Strategy = s
+		status.Reason = reason
+		logger.Infof("using magic IP %s from %s: %s\n", address, s, reason)
+		return status
+	}
+	// the loopback alias is always there as a last resort
+	status.Address = loopbackAliasAddress()
+	status.Strategy = "fallback"
+	status.Reason = "no strategy succeeded, using the loopback alias"
+	logger.Warningf("using magic IP %s: %s\n", status.Address, status.Reason)
+	return status
+}
+
+// make sure the address is actually on this host, so we don't hand out something unreachable
+func checkLocalAddress(address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address", address)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an address of any local interface", address)
+}
+
+// when docker is somewhere else (a remote docker context), that's where the names should point
+func dockerContextAddress(arg string) (string, string, error) {
+	endpoint := util.DockerHost()
+	host, err := util.RemoteDockerHost(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("docker is local")
+	}
+	address, err := util.ResolveSSHHost(host)
+	if err != nil {
+		return "", "", fmt.Errorf("docker host %s: %s", endpoint, err)
+	}
+	return address, fmt.Sprintf("docker context endpoint %s", endpoint), nil
+}
+
+func bridgeGatewayAddress(arg string) (string, string, error) {
+	return dockerNetworkAddress("bridge")
+}
+
+func dockerNetworkAddress(network string) (string, string, error) {
+	if network == "" {
+		return "", "", fmt.Errorf("no docker network name given (use network:NAME)")
+	}
+	out, _, err := util.RunDocker(util.Options{}, "network", "inspect", network)
+	if err != nil {
+		return "", "", fmt.Errorf("docker network inspect %s: %s", network, err)
+	}
+	var result []struct {
+		IPAM struct {
+			Config []struct {
+				Gateway string
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return "", "", fmt.Errorf("docker network inspect %s: %s", network, err)
+	}
+	for _, n := range result {
+		for _, c := range n.IPAM.Config {
+			if c.Gateway != "" {
+				return c.Gateway, fmt.Sprintf("gateway of docker network %s", network), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("docker network %s has no IPAM gateway", network)
+}
+
+func publishedPortAddress(arg string) (string, string, error) {
+	out, _, err := util.RunDocker(util.Options{}, "inspect", "cirri")
+	if err != nil {
+		return "", "", fmt.Errorf("docker inspect cirri: %s", err)
+	}
+	var result []struct {
+		NetworkSettings struct {
+			Ports map[string][]struct {
+				HostIp   string
+				HostPort string
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return "", "", fmt.Errorf("docker inspect cirri: %s", err)
+	}
+	for _, c := range result {
+		for port, bindings := range c.NetworkSettings.Ports {
+			for _, b := range bindings {
+				ip := net.ParseIP(b.HostIp)
+				if ip == nil || ip.IsUnspecified() {
+					continue
+				}
+				return b.HostIp, fmt.Sprintf("cirri container publishes %s on %s:%s", port, b.HostIp, b.HostPort), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("cirri container has no ports published on a specific host IP")
+}
+
+func defaultRouteAddress(arg string) (string, string, error) {
+	// UDP "connect" doesn't send anything, but does make the kernel pick the outgoing interface
+	conn, err := net.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		return "", "", fmt.Errorf("no default route: %s", err)
+	}
+	defer conn.Close()
+	address := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	return address, "address of the default route interface", nil
+}
+
+func loopbackAddress(arg string) (string, string, error) {
+	return loopbackAliasAddress(), "loopback alias", nil
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// fakeDocker answers cirrid's docker commands for the length of a test
+func fakeDocker(t *testing.T) *util.FakeExecutor {
+	SetLogger(service.ConsoleLogger)
+	util.SetDockerHost("")
+	fake := &util.FakeExecutor{}
+	t.Cleanup(util.UseExecutor(fake))
+	return fake
+}
+
+func TestDockerNetworkAddress(t *testing.T) {
+	fake := fakeDocker(t)
+	fake.Expect("docker", "network", "inspect", "cirri").
+		Returns(`[{"Name": "cirri", "IPAM": {"Config": [{"Subnet": "172.20.0.0/16", "Gateway": "172.20.0.1"}]}}]`)
+
+	address, reason, err := dockerNetworkAddress("cirri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "172.20.0.1" {
+		t.Errorf("got %s (%s)", address, reason)
+	}
+}
+
+func TestDockerNetworkAddressNoDocker(t *testing.T) {
+	fake := fakeDocker(t)
+	fake.Expect("docker", "network", "inspect", "bridge").
+		Fails(1, "Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")
+
+	_, _, err := bridgeGatewayAddress("")
+	if err == nil || !strings.Contains(err.Error(), "Is the docker daemon running?") {
+		t.Errorf("expected docker's complaint, got %v", err)
+	}
+}
+
+// unspecified (0.0.0.0) bindings don't say which address to use, the first specific one does
+func TestPublishedPortAddress(t *testing.T) {
+	fake := fakeDocker(t)
+	fake.Expect("docker", "inspect", "cirri").
+		Returns(`[{"NetworkSettings": {"Ports": {
+			"80/tcp": [{"HostIp": "0.0.0.0", "HostPort": "80"}],
+			"443/tcp": [{"HostIp": "192.0.2.7", "HostPort": "443"}]
+		}}}]`)
+
+	address, _, err := publishedPortAddress("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "192.0.2.7" {
+		t.Errorf("got %s", address)
+	}
+}
+
+// each strategy that fails is recorded, and the first one giving a local address wins
+func TestFindMagic(t *testing.T) {
+	fake := fakeDocker(t)
+	fake.Expect("docker", "network", "inspect", "bridge").Fails(1, "Error: No such network: bridge")
+	// not an address of this host
+	fake.Expect("docker", "network", "inspect", "cirri").
+		Returns(`[{"IPAM": {"Config": [{"Gateway": "192.0.2.1"}]}}]`)
+	fake.Expect("docker", "network", "inspect", "lo").
+		Returns(`[{"IPAM": {"Config": [{"Gateway": "127.0.0.1"}]}}]`)
+
+	status := findMagic([]string{"bridge", "network:cirri", "network:lo", "loopback"})
+	if status.Address != "127.0.0.1" || status.Strategy != "network:lo" {
+		t.Errorf("got %s from %s", status.Address, status.Strategy)
+	}
+	if len(status.Attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %+v", status.Attempts)
+	}
+	for i, want := range []string{"No such network", "not an address of any local interface", "ok"} {
+		if !strings.Contains(status.Attempts[i].Result, want) {
+			t.Errorf("attempt %s: %q, want %q", status.Attempts[i].Strategy, status.Attempts[i].Result, want)
+		}
+	}
+	if unmet := fake.Unmet(); len(unmet) > 0 {
+		t.Errorf("not run: %q", unmet)
+	}
+}
+
+func TestFindMagicFallsBackToLoopback(t *testing.T) {
+	fake := fakeDocker(t)
+	fake.Expect("docker", "network", "inspect", "bridge").Fails(1, "Error: No such network: bridge")
+
+	status := findMagic([]string{"bridge"})
+	if status.Address != loopbackAliasAddress() {
+		t.Errorf("got %s from %s", status.Address, status.Strategy)
+	}
+}
+
+func TestGetCirriStackdomain(t *testing.T) {
+	fake := fakeDocker(t)
+	fake.Expect("docker", "inspect", "cirri").
+		Returns(`[{"Config": {"Env": ["PATH=/usr/bin", "STACKDOMAIN=stack.ona.im"]}}]`)
+	fake.Expect("docker", "inspect", "cirri").Fails(1, "Error: No such object: cirri")
+
+	if got := GetCirriStackdomain(); got != "stack.ona.im" {
+		t.Errorf("got %q", got)
+	}
+	// no cirri container, no stackdomain
+	if got := GetCirriStackdomain(); got != "" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// with a remote docker context, docker commands go to its endpoint
+func TestRunDockerFollowsContext(t *testing.T) {
+	fake := fakeDocker(t)
+	util.SetDockerHost("ssh://me@beefy")
+	defer util.SetDockerHost("")
+	fake.Expect("docker", "-H", "ssh://me@beefy", "inspect", "cirri").
+		Returns(`[{"Config": {"Env": ["STACKDOMAIN=beefy.ona.im"]}}]`)
+
+	if got := GetCirriStackdomain(); got != "beefy.ona.im" {
+		t.Errorf("got %q", got)
+	}
+}
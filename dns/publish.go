@@ -0,0 +1,108 @@
+package dns
+
+// names that come and go (eg a remote cirri host's containers) are published by a source,
+// which replaces all of its names each time, so the ones that went away are removed too
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Host is a name to publish, relative to its zone, and the IPv4 address it points at
+type Host struct {
+	Name    string
+	Address string
+}
+
+// the record owners each source has published
+var publishedBy = map[string][]string{}
+
+// Publish replaces the names source published last time with hosts, adding wildcards as the zone says to.
+// Names that something else (eg the cfg file) has already set are left alone.
+func Publish(source, zone string, hosts []Host) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	for _, owner := range publishedBy[source] {
+		delete(records, owner)
+	}
+	publishedBy[source] = nil
+
+	origin := strings.ToLower(dns.Fqdn(strings.Trim(zone, ".")))
+	ttl := uint32(DefaultTTL)
+	zoneWildcard := true
+	if z := findZone(origin); z != nil {
+		ttl = z.TTL
+		zoneWildcard = z.Wildcard
+	}
+	var errs []string
+	for _, h := range hosts {
+		owner := strings.ToLower(strings.Trim(h.Name, ".")) + "." + origin
+		if ip := net.ParseIP(h.Address); ip == nil || ip.To4() == nil {
+			errs = append(errs, fmt.Sprintf("%s: %q is not an IPv4 address", owner, h.Address))
+			continue
+		}
+		if _, taken := records[owner]; taken {
+			logger.Warningf("Not publishing %s for %s, its already set\n", owner, source)
+			continue
+		}
+		records[owner] = []dns.RR{newA(owner, h.Address, ttl)}
+		publishedBy[source] = append(publishedBy[source], owner)
+
+		wildcard := zoneWildcard
+		if enabled, ok := wildcardOverrides[owner]; ok {
+			wildcard = enabled
+		}
+		if _, taken := records["*."+owner]; wildcard && !taken {
+			records["*."+owner] = []dns.RR{newA("*."+owner, h.Address, ttl)}
+			publishedBy[source] = append(publishedBy[source], "*."+owner)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// AddTXT adds a TXT record (eg an ACME dns-01 challenge) at a name in one of our zones
+func AddTXT(name, value string) error {
+	owner := strings.ToLower(dns.Fqdn(name))
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	z := findZone(owner)
+	if z == nil {
+		return fmt.Errorf("%s isn't in any of our zones", owner)
+	}
+	for _, rr := range records[owner] {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return nil
+		}
+	}
+	records[owner] = append(records[owner], &dns.TXT{
+		Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: z.TTL},
+		Txt: []string{value},
+	})
+	return nil
+}
+
+// RemoveTXT removes a TXT record AddTXT added
+func RemoveTXT(name, value string) {
+	owner := strings.ToLower(dns.Fqdn(name))
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	kept := []dns.RR{}
+	for _, rr := range records[owner] {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	if len(kept) == 0 {
+		delete(records, owner)
+	} else {
+		records[owner] = kept
+	}
+}
@@ -0,0 +1,143 @@
+package dns
+
+// DNS-over-HTTPS (RFC 8484) and DNS-over-TLS (RFC 7858) listeners, for the browsers and
+// containers that skip the host resolver. They answer with the same handler (and records)
+// as the plain DNS listener, and forward everything else upstream.
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SecureConfig is where the DoH and DoT listeners go
+type SecureConfig struct {
+	// the address to listen on, "magic" for the magic address
+	Address string
+	// the name clients use (relative to Zone), published pointing at the address
+	Name string
+	Zone string
+	// 0 to not listen
+	DoHPort int
+	DoTPort int
+	TLS     *tls.Config
+}
+
+const dnsMessage = "application/dns-message"
+
+// the DoH URL and DoT address clients can be pointed at, once they're listening
+var secureEndpoints []string
+
+// ServeSecure publishes the listeners' name, and starts them in the background
+func ServeSecure(c SecureConfig) error {
+	if c.Address == "" || c.Address == "magic" {
+		c.Address = GetMagic().Address
+	}
+	if err := Publish("secure dns", c.Zone, []Host{{Name: c.Name, Address: c.Address}}); err != nil {
+		return err
+	}
+	name := strings.Trim(c.Name, ".") + "." + strings.Trim(c.Zone, ".")
+
+	if c.DoTPort > 0 {
+		srv := &dns.Server{
+			Addr:      net.JoinHostPort(c.Address, strconv.Itoa(c.DoTPort)),
+			Net:       "tcp-tls",
+			TLSConfig: c.TLS,
+			Handler:   &handler{},
+		}
+		logger.Infof("DNS-over-TLS listening on %s\n", srv.Addr)
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				logger.Errorf("DNS-over-TLS listener stopped: %s\n", err)
+			}
+		}()
+		secureEndpoints = append(secureEndpoints, "tls://"+net.JoinHostPort(name, strconv.Itoa(c.DoTPort)))
+	}
+	if c.DoHPort > 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/dns-query", dohQuery)
+		srv := &http.Server{
+			Addr:      net.JoinHostPort(c.Address, strconv.Itoa(c.DoHPort)),
+			Handler:   mux,
+			TLSConfig: c.TLS,
+		}
+		logger.Infof("DNS-over-HTTPS listening on %s\n", srv.Addr)
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != nil {
+				logger.Errorf("DNS-over-HTTPS listener stopped: %s\n", err)
+			}
+		}()
+		secureEndpoints = append(secureEndpoints, "https://"+net.JoinHostPort(name, strconv.Itoa(c.DoHPort))+"/dns-query")
+	}
+	return nil
+}
+
+// SecureEndpoints lists the DoH URL and DoT address, if they're listening
+func SecureEndpoints() []string {
+	return secureEndpoints
+}
+
+// dohQuery takes a GET with ?dns=, or a POST of the message
+func dohQuery(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessage {
+			http.Error(w, "expected "+dnsMessage, http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if len(packed) > dns.MaxMsgSize {
+			http.Error(w, "DNS messages are at most 65535 bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "GET or POST a DNS message", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(packed) == 0 {
+		http.Error(w, fmt.Sprintf("no DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(packed); err != nil || len(m.Question) != 1 {
+		http.Error(w, fmt.Sprintf("bad DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	reply := Exchange(m)
+	out, err := reply.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessage)
+	// HTTP caches can keep it as long as the shortest TTL (RFC 8484 5.1)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(reply)))
+	w.Write(out)
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
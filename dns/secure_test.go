@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHQuery(t *testing.T) {
+	useStore(t, "host A 192.0.2.1")
+	q := new(dns.Msg)
+	q.SetQuestion("host.ona.im.", dns.TypeA)
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(packed)
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{name: "GET", method: http.MethodGet, target: "/dns-query?dns=" + encoded, status: http.StatusOK},
+		{name: "GET with padding", method: http.MethodGet, target: "/dns-query?dns=" + base64.URLEncoding.EncodeToString(packed), status: http.StatusOK},
+		{name: "GET not base64url", method: http.MethodGet, target: "/dns-query?dns=" + base64.StdEncoding.EncodeToString([]byte{0xfb, 0xff}), status: http.StatusBadRequest},
+		{name: "GET without dns", method: http.MethodGet, target: "/dns-query", status: http.StatusBadRequest},
+		{name: "POST", method: http.MethodPost, target: "/dns-query", contentType: dnsMessage, body: packed, status: http.StatusOK},
+		{name: "POST bad content type", method: http.MethodPost, target: "/dns-query", contentType: "application/json", body: packed, status: http.StatusUnsupportedMediaType},
+		{name: "POST not a DNS message", method: http.MethodPost, target: "/dns-query", contentType: dnsMessage, body: []byte("hello"), status: http.StatusBadRequest},
+		{name: "POST too big", method: http.MethodPost, target: "/dns-query", contentType: dnsMessage,
+			body: append(append([]byte{}, packed...), make([]byte, dns.MaxMsgSize)...), status: http.StatusRequestEntityTooLarge},
+		{name: "PUT", method: http.MethodPut, target: "/dns-query", contentType: dnsMessage, body: packed, status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			dohQuery(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != dnsMessage {
+				t.Errorf("content type %q", ct)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "max-age=60" {
+				t.Errorf("cache control %q", cc)
+			}
+			reply := new(dns.Msg)
+			if err := reply.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if got := brief(reply.Answer); len(got) != 1 || got[0] != "host.ona.im. A 192.0.2.1" {
+				t.Errorf("answer %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package dns
+
+// upstream servers answer for the names we don't claim (in our zones or not), which only DoH and DoT clients
+// (or anything else pointed straight at cirrid) ask us about
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var upstreamLock sync.RWMutex
+var upstream []string
+
+// SetUpstream sets the servers asked about names we don't claim,
+// "system" is the nameservers in /etc/resolv.conf (other than cirrid itself)
+func SetUpstream(servers []string) {
+	list := []string{}
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		switch {
+		case server == "":
+		case server == "system":
+			list = append(list, systemResolvers()...)
+		default:
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			list = append(list, server)
+		}
+	}
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	upstream = list
+}
+
+// Upstream is the servers asked about names we don't claim
+func Upstream() []string {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	return upstream
+}
+
+// there's no resolv.conf on windows, so no system resolvers either
+func systemResolvers() []string {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	list := []string{}
+	for _, server := range conf.Servers {
+		if server == getDNSServerIPAddress() {
+			continue
+		}
+		list = append(list, net.JoinHostPort(server, conf.Port))
+	}
+	return list
+}
@@ -0,0 +1,187 @@
+package main
+
+// `cirrid doctor` - check all the things we'd otherwise debug by hand with dig, resolvectl and docker inspect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/util"
+
+	"github.com/kardianos/service"
+	mdns "github.com/miekg/dns"
+)
+
+type doctorCheck struct {
+	name   string
+	ok     bool
+	detail string
+	fix    string
+}
+
+func (c doctorCheck) print() {
+	result := " OK "
+	if !c.ok {
+		result = "FAIL"
+	}
+	fmt.Printf("[%s] %s", result, c.name)
+	if c.detail != "" {
+		fmt.Printf(": %s", c.detail)
+	}
+	fmt.Println()
+	if !c.ok && c.fix != "" {
+		fmt.Printf("       fix: %s\n", c.fix)
+	}
+}
+
+func passed(name, detail string) doctorCheck {
+	return doctorCheck{name: name, ok: true, detail: detail}
+}
+
+func failed(name, detail, fix string) doctorCheck {
+	return doctorCheck{name: name, detail: detail, fix: fix}
+}
+
+func checkPrivileges() doctorCheck {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		return passed("privileges", "running as root")
+	}
+	return failed("privileges", "not running as root, some checks may fail", "run 'sudo cirrid doctor'")
+}
+
+func checkService(s service.Service) doctorCheck {
+	status, err := s.Status()
+	switch {
+	case err == service.ErrNotInstalled:
+		return failed("service", "not installed", "run 'sudo cirrid install'")
+	case err != nil:
+		return failed("service", err.Error(), "check the service manager's logs")
+	case status != service.StatusRunning:
+		return failed("service", "installed, but not running", "run 'sudo cirrid start'")
+	}
+	return passed("service", "installed and running")
+}
+
+// queryCirrid asks the cirrid DNS server directly
+func queryCirrid(address, name string) ([]string, error) {
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn(name), mdns.TypeA)
+	c := &mdns.Client{Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, address)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []string{}
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*mdns.A); ok {
+			addresses = append(addresses, a.A.String())
+		}
+	}
+	return addresses, nil
+}
+
+func checkListener(status daemonStatus) doctorCheck {
+	c := &mdns.Client{Timeout: 2 * time.Second}
+	m := new(mdns.Msg)
+	m.SetQuestion("cirrid-doctor.invalid.", mdns.TypeA)
+	if _, _, err := c.Exchange(m, status.DNSAddress); err != nil {
+		return failed("dns listener", fmt.Sprintf("no answer from %s: %s", status.DNSAddress, err), "check the service log for listener errors (is something else using the port?)")
+	}
+	return passed("dns listener", "answering on "+status.DNSAddress)
+}
+
+func checkResolver(status daemonStatus) doctorCheck {
+	problems := dns.CheckResolveConfigured(status.RoutingDomains)
+	if len(problems) > 0 {
+		return failed("resolver", strings.Join(problems, "; "), "run 'sudo cirrid restart' to rewrite the resolver settings")
+	}
+	return passed("resolver", fmt.Sprintf("%d domains sent to cirrid", len(status.RoutingDomains)))
+}
+
+// checkResolution compares what the system resolver says for each A record with what cirrid says
+func checkResolution(status daemonStatus) []doctorCheck {
+	checks := []doctorCheck{}
+	for _, record := range status.Records {
+		rr, err := mdns.NewRR(record)
+		if err != nil || rr == nil || rr.Header().Rrtype != mdns.TypeA {
+			continue
+		}
+		name := strings.TrimSuffix(rr.Header().Name, ".")
+		if strings.HasPrefix(name, "*.") {
+			name = "cirrid-doctor" + strings.TrimPrefix(name, "*")
+		}
+		check := "resolve " + name
+		direct, err := queryCirrid(status.DNSAddress, name)
+		if err != nil || len(direct) == 0 {
+			checks = append(checks, failed(check, fmt.Sprintf("cirrid didn't answer: %v", err), "check the service log"))
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		system, err := net.DefaultResolver.LookupHost(ctx, name)
+		cancel()
+		if err != nil {
+			checks = append(checks, failed(check, fmt.Sprintf("cirrid says %s, the system resolver fails: %s", strings.Join(direct, ","), err), "check the resolver settings, and flush the resolver cache ('sudo cirrid restart')"))
+			continue
+		}
+		if strings.Join(system, ",") != strings.Join(direct, ",") {
+			checks = append(checks, failed(check, fmt.Sprintf("cirrid says %s, the system resolver says %s", strings.Join(direct, ","), strings.Join(system, ",")), "something else is answering for this name - check /etc/hosts and the resolver settings"))
+			continue
+		}
+		checks = append(checks, passed(check, strings.Join(system, ",")))
+	}
+	return checks
+}
+
+func checkDocker() doctorCheck {
+	out, stderr, err := util.RunDocker(util.Options{}, "version", "--format", "{{.Server.Version}}")
+	if err != nil || strings.TrimSpace(out) == "" {
+		return failed("docker", strings.TrimSpace(fmt.Sprintf("%v %s", err, stderr)), "start docker, and make sure 'docker version' works (or 'cirrid context use' another)")
+	}
+	return passed("docker", "server version "+strings.TrimSpace(out))
+}
+
+func checkCirriContainer() doctorCheck {
+	out, stderr, err := util.RunDocker(util.Options{}, "inspect", "--format", "{{.State.Status}}", "cirri")
+	if err != nil || strings.TrimSpace(out) == "" {
+		return failed("cirri container", strings.TrimSpace(fmt.Sprintf("%v %s", err, stderr)), "start the cirri stack, or set ask_cirri = false")
+	}
+	if strings.TrimSpace(out) != "running" {
+		return failed("cirri container", "container is "+strings.TrimSpace(out), "start the cirri stack")
+	}
+	return passed("cirri container", "running")
+}
+
+func doctorCmd(s service.Service, args []string) error {
+	checks := []doctorCheck{checkPrivileges(), checkService(s)}
+
+	var status daemonStatus
+	if err := control.Get("/status", &status); err != nil {
+		checks = append(checks, failed("control api", err.Error(), "start the service with 'sudo cirrid start'"))
+	} else {
+		checks = append(checks, passed("control api", "cirrid "+status.Version))
+		checks = append(checks, checkListener(status), checkResolver(status))
+		checks = append(checks, checkResolution(status)...)
+		// check the docker the daemon is following
+		util.SetDockerHost(status.DockerHost)
+	}
+	checks = append(checks, checkDocker(), checkCirriContainer())
+
+	failures := 0
+	for _, c := range checks {
+		c.print()
+		if !c.ok {
+			failures++
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d checks failed", failures, len(checks))
+	}
+	return nil
+}
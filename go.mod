@@ -8,5 +8,6 @@ require (
 	github.com/kardianos/service v1.2.0
 	github.com/miekg/dns v1.1.41
 	github.com/smartystreets/goconvey v1.6.4 // indirect
+	golang.org/x/sys v0.0.0-20210303074136-134d130e1a04
 	gopkg.in/ini.v1 v1.62.0
 )
@@ -2,23 +2,41 @@ package install
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
-
-	"github.com/onaci/cirrid/util"
-
-	version "github.com/hashicorp/go-version"
+	"runtime"
 )
 
 var InstallDir = "/usr/local/bin"
+
+// set at build time by the Makefile
 var Commit = "DEVELOPMENT"
 var BuildTime = "DEVELOPMENT"
-var Version = "v0." + BuildTime + "+" + Commit
+
+// Version is the release tag, v0.BUILDTIME (with -dirty for uncommitted changes), so releases sort by
+// when they were built - it's set at build time too, as -X can't set a var built from the others
+var Version = "DEVELOPMENT"
 var cmdDryRun = false
 
+// SetDryRun makes install only log what it would do
+func SetDryRun(dryRun bool) {
+	cmdDryRun = dryRun
+}
+
+// InstallBin installs the running binary as InstallDir/cirrid-VERSION, and links InstallDir/cirrid to it
 func InstallBin() error {
+	cirriRunPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return installBinary(cirriRunPath, Version)
+}
+
+// ensureInstallDir makes sure InstallDir is there, and that we can write to it
+func ensureInstallDir() error {
 	stat, err := os.Stat(InstallDir)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -38,22 +56,34 @@ func InstallBin() error {
 		return fmt.Errorf("InstallDir %s is not a directory", InstallDir)
 	}
 
-	if err := checkPermission(stat, InstallDir); err != nil {
+	return checkPermission(stat, InstallDir)
+}
+
+// installBinary installs cirriRunPath (which is binaryVersion) as InstallDir/cirrid-VERSION, and links InstallDir/cirrid to it
+func installBinary(cirriRunPath, binaryVersion string) error {
+	if err := ensureInstallDir(); err != nil {
 		return err
 	}
 
-	cirriRunPath, err := os.Executable()
-	if err != nil {
-		return err
+	if RequireSigned {
+		if err := VerifySignature(cirriRunPath); err != nil {
+			return fmt.Errorf("require_signed is set, refusing to install %s: %s", cirriRunPath, err)
+		}
 	}
-	versionForFileName := Version
-	if strings.Contains(versionForFileName, "-dirty") {
+
+	versionForFileName := binaryVersion
+	if IsDevelopment(versionForFileName) {
 		versionForFileName = "DEVELOPMENT"
 	}
 	cirriDestinationPath := filepath.Join(InstallDir, fmt.Sprintf("%s-%s", "cirrid", versionForFileName))
-	if err := updateBinary(cirriRunPath, cirriDestinationPath, cmdDryRun); err != nil {
+	if err := updateBinary(cirriRunPath, binaryVersion, cirriDestinationPath, cmdDryRun); err != nil {
 		return err
 	}
+	if !cmdDryRun && cirriRunPath != cirriDestinationPath {
+		if err := copySignature(cirriRunPath, cirriDestinationPath); err != nil {
+			return err
+		}
+	}
 	aliasPath := filepath.Join(InstallDir, "cirrid")
 	if err := ensureSoftLink(cirriDestinationPath, aliasPath, cmdDryRun); err != nil {
 		return err
@@ -61,15 +91,15 @@ func InstallBin() error {
 	return nil
 }
 
-func updateBinary(newBinary, destinationPath string, dryRun bool) error {
+func updateBinary(newBinary, newVersion, destinationPath string, dryRun bool) error {
 	if newBinary == destinationPath {
 		log.Printf("Skipping %s, its the binary we're running\n", newBinary)
 		return nil
 	}
 
 	InstallNeeded := ""
-	if BuildTime == "DEVELOPMENT" || strings.Contains(Version, "-dirty") {
-		InstallNeeded = BuildTime
+	if IsDevelopment(newVersion) {
+		InstallNeeded = fmt.Sprintf("Install triggered: %s is a development build", newVersion)
 	} else {
 		// is there a possible old binary installed
 		_, err := os.Stat(destinationPath)
@@ -80,25 +110,17 @@ func updateBinary(newBinary, destinationPath string, dryRun bool) error {
 			InstallNeeded = fmt.Sprintf("Install triggered: %s does not exist", destinationPath)
 		} else {
 			// get version of existing installed bin
-			out, stderr, err := util.RunLocally(util.Options{}, destinationPath, "version", "--show-only=cirri", "--format={{.Version}}")
+			installed, err := BinaryVersion(destinationPath)
 			if err != nil {
-				log.Printf("%s\n", out)
-				log.Printf("%s\n", stderr)
 				log.Printf("%s\n", err)
-
 				return err
 			}
-			installedVersion, err := version.NewVersion(strings.TrimPrefix(strings.TrimSpace(out), "v"))
+			older, err := CompareVersions(installed.Version, newVersion)
 			if err != nil {
 				return err
 			}
-			binaryVersion, err := version.NewVersion(strings.TrimPrefix(Version, "v"))
-			if err != nil {
-				return err
-			}
-
-			if installedVersion.LessThan(binaryVersion) {
-				InstallNeeded = fmt.Sprintf("Install triggered: %s is version %s, we have %s", destinationPath, installedVersion, Version)
+			if older < 0 {
+				InstallNeeded = fmt.Sprintf("Install triggered: %s is version %s, we have %s", destinationPath, installed.Version, newVersion)
 			}
 		}
 	}
@@ -108,27 +130,61 @@ func updateBinary(newBinary, destinationPath string, dryRun bool) error {
 		return nil
 	}
 
-	//copy the file!
-
-	// TODO: determine if we have permission to write to the dir...
-	// TODO: make sure the destination is in the path..
-
 	if dryRun {
 		log.Printf("DryRun - install %s to %s: %s\n", newBinary, destinationPath, InstallNeeded)
-	} else {
-		log.Printf("installing %s to %s: %s\n", newBinary, destinationPath, InstallNeeded)
-		// do the copy using cmdline so we can use --sudo when needed...
-		// TODO: --sudo...?
-		out, stderr, err := util.RunLocally(util.Options{}, "rsync", newBinary, destinationPath)
-		if err != nil {
-			log.Printf("%s\n", out)
-			log.Printf("%s\n", stderr)
-			log.Printf("%s\n", err)
+		return nil
+	}
+	log.Printf("installing %s to %s: %s\n", newBinary, destinationPath, InstallNeeded)
+	return copyBinary(newBinary, destinationPath)
+}
 
-			return err
-		}
+// copyBinary copies src to a temp file next to dest, and renames it into place,
+// so dest is never a partially written file
+func copyBinary(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
 
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".cirrid-install-")
+	if err != nil {
+		return err
+	}
+	// cleans up if we don't get as far as the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dest))
+}
+
+// syncDir makes sure a rename in dir is on disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
 	return nil
 }
 
@@ -139,7 +195,6 @@ func ensureSoftLink(sourcePath, destinationPath string, dryRun bool) error {
 	}
 
 	InstallNeeded := ""
-	rmNeeded := false
 	// is there a possible old binary installed
 	lstat, err := os.Lstat(destinationPath)
 	if err != nil {
@@ -150,7 +205,9 @@ func ensureSoftLink(sourcePath, destinationPath string, dryRun bool) error {
 	} else {
 		// make sure we're a Link
 		if lstat.Mode()&os.ModeSymlink == 0 {
-			rmNeeded = true
+			if lstat.IsDir() {
+				return fmt.Errorf("%s is a directory, not a softlink", destinationPath)
+			}
 			InstallNeeded = fmt.Sprintf("%s is not a softlink", destinationPath)
 		} else {
 			finalPath, err := os.Readlink(destinationPath)
@@ -158,7 +215,6 @@ func ensureSoftLink(sourcePath, destinationPath string, dryRun bool) error {
 				return err
 			}
 			if finalPath != sourcePath {
-				rmNeeded = true
 				InstallNeeded = fmt.Sprintf("%s points to %s, needs to link to %s", destinationPath, finalPath, sourcePath)
 			}
 		}
@@ -169,27 +225,11 @@ func ensureSoftLink(sourcePath, destinationPath string, dryRun bool) error {
 		return nil
 	}
 
-	//copy the file!
-
-	// TODO: determine if we have permission to write to the dir...
-	// TODO: make sure the destination is in the path..
-
 	if dryRun {
 		log.Printf("DryRun - link %s to %s: %s\n", destinationPath, sourcePath, InstallNeeded)
-	} else {
-		log.Printf("linking %s to %s: %s\n", destinationPath, sourcePath, InstallNeeded)
-		// TODO: likely need to try to remove the link
-		if rmNeeded {
-			if err = os.Remove(destinationPath); err != nil {
-				return err
-			}
-		}
-		// do the copy using cmdline so we can use --sudo when needed...
-		// TODO: --sudo...?
-		if err = os.Symlink(sourcePath, destinationPath); err != nil {
-			return nil
-		}
+		return nil
 	}
-
-	return nil
+	log.Printf("linking %s to %s: %s\n", destinationPath, sourcePath, InstallNeeded)
+	// the rename replaces whatever was there, so there's always a cirrid to run
+	return replaceSymlink(sourcePath, destinationPath)
 }
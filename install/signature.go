@@ -0,0 +1,105 @@
+package install
+
+// ed25519 signatures for release binaries.
+// A release binary 'cirrid' is signed in 'cirrid.sig', which holds the base64 signature of the whole file.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SigningPublicKey is the base64 ed25519 key release binaries are signed with,
+// set at build time with -X github.com/onaci/cirrid/install.SigningPublicKey=...
+var SigningPublicKey = ""
+
+// RequireSigned stops InstallBin (and upgrade) from installing a binary without a valid signature
+var RequireSigned = false
+
+func signaturePath(path string) string {
+	return path + ".sig"
+}
+
+func publicKey() (ed25519.PublicKey, error) {
+	if SigningPublicKey == "" {
+		return nil, fmt.Errorf("this build of cirrid has no signing key, so can't verify signatures")
+	}
+	key, err := base64.StdEncoding.DecodeString(SigningPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad signing key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad signing key: wrong size %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// VerifySignature checks path against the signature in path.sig
+func VerifySignature(path string) error {
+	key, err := publicKey()
+	if err != nil {
+		return err
+	}
+	encoded, err := ioutil.ReadFile(signaturePath(path))
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("%s: %s", signaturePath(path), err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, contents, signature) {
+		return fmt.Errorf("%s is not validly signed", path)
+	}
+	return nil
+}
+
+// GenerateSigningKey writes a new base64 private key to keyPath, and returns the base64 public key to build with
+func GenerateSigningKey(keyPath string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// SignFile signs path with the private key in keyPath, writing path.sig
+func SignFile(keyPath, path string) error {
+	encoded, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not a base64 ed25519 private key", keyPath)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signature := ed25519.Sign(ed25519.PrivateKey(key), contents)
+	return ioutil.WriteFile(signaturePath(path), []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0644)
+}
+
+// copySignature puts the signature for src next to dest, so installed binaries stay verifiable
+func copySignature(src, dest string) error {
+	signature, err := ioutil.ReadFile(signaturePath(src))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(signaturePath(dest), signature, 0644)
+}
@@ -0,0 +1,331 @@
+package install
+
+// find, download and verify cirrid releases
+// anything that speaks the GitHub releases API will do, so a local stand-in server can be used for testing
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// ReleasesURL is the GitHub (compatible) API for the cirrid repository
+var ReleasesURL = "https://api.github.com/repos/onaci/cirrid"
+
+// Prerelease allows upgrading to releases marked as prereleases
+var Prerelease = false
+
+// checksum files we look for in a release, the first being one line per asset
+var checksumAssets = []string{"SHA256SUMS", "sha256sums.txt", "checksums.txt"}
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+type Release struct {
+	TagName    string  `json:"tag_name"`
+	Name       string  `json:"name"`
+	Draft      bool    `json:"draft"`
+	Prerelease bool    `json:"prerelease"`
+	Assets     []Asset `json:"assets"`
+}
+
+type Asset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// the release asset for this OS/arch, as named by the Makefile
+func assetName() string {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64":
+		return "cirrid"
+	case "darwin/amd64":
+		return "cirrid-osx"
+	case "windows/amd64":
+		return "cirrid.exe"
+	}
+	return fmt.Sprintf("cirrid-%s-%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func (r *Release) asset(name string) *Asset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+func parseVersion(v string) (*version.Version, error) {
+	return version.NewVersion(strings.TrimPrefix(strings.TrimSpace(v), "v"))
+}
+
+func get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("User-Agent", "cirrid/"+Version)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// LatestRelease finds the newest release that has a binary for this OS/arch
+func LatestRelease() (*Release, error) {
+	resp, err := get(strings.TrimSuffix(ReleasesURL, "/") + "/releases")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var releases []Release
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, fmt.Errorf("reading releases from %s: %s", ReleasesURL, err)
+	}
+
+	var latest *Release
+	var latestVersion *version.Version
+	for i, r := range releases {
+		if r.Draft || (r.Prerelease && !Prerelease) || r.asset(assetName()) == nil {
+			continue
+		}
+		v, err := parseVersion(r.TagName)
+		if err != nil {
+			log.Printf("Skipping release %s: %s\n", r.TagName, err)
+			continue
+		}
+		if latestVersion == nil || v.GreaterThan(latestVersion) {
+			latest = &releases[i]
+			latestVersion = v
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no releases for %s/%s found at %s", runtime.GOOS, runtime.GOARCH, ReleasesURL)
+	}
+	return latest, nil
+}
+
+// expectedChecksum finds the SHA-256 for name in the release's checksum file
+func (r *Release) expectedChecksum(name string) (string, error) {
+	if a := r.asset(name + ".sha256"); a != nil {
+		resp, err := get(a.BrowserDownloadURL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(string(body))
+		if len(fields) == 0 {
+			return "", fmt.Errorf("%s is empty", a.Name)
+		}
+		return strings.ToLower(fields[0]), nil
+	}
+	for _, checksums := range checksumAssets {
+		a := r.asset(checksums)
+		if a == nil {
+			continue
+		}
+		resp, err := get(a.BrowserDownloadURL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		// sha256sum format: "<hash>  <name>", or "<hash> *<name>" for binary mode
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%s has no checksum for %s", checksums, name)
+	}
+	return "", fmt.Errorf("release %s has no checksum file", r.TagName)
+}
+
+// Download fetches the release's binary for this OS/arch into InstallDir, and verifies its checksum and signature.
+// The caller should remove the returned file once its installed.
+func Download(r *Release) (string, error) {
+	name := assetName()
+	a := r.asset(name)
+	if a == nil {
+		return "", fmt.Errorf("release %s has no %s", r.TagName, name)
+	}
+	expected, err := r.expectedChecksum(name)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureInstallDir(); err != nil {
+		return "", err
+	}
+
+	log.Printf("Downloading %s\n", a.BrowserDownloadURL)
+	resp, err := get(a.BrowserDownloadURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	tmp, err := ioutil.TempFile(InstallDir, ".cirrid-download-")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != expected {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", a.Name, expected, actual)
+	}
+	log.Printf("OK: %s has SHA-256 %s\n", a.Name, actual)
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := r.verifySignature(name, tmp.Name()); err != nil {
+		removeDownload(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// verifySignature downloads the release's signature for name, and checks the downloaded binary with it
+func (r *Release) verifySignature(name, binary string) error {
+	a := r.asset(name + ".sig")
+	if a == nil {
+		if RequireSigned {
+			return fmt.Errorf("require_signed is set, and release %s has no signature for %s", r.TagName, name)
+		}
+		log.Printf("WARNING: release %s has no signature for %s\n", r.TagName, name)
+		return nil
+	}
+	resp, err := get(a.BrowserDownloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	signature, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(signaturePath(binary), signature, 0644); err != nil {
+		return err
+	}
+	if err := VerifySignature(binary); err != nil {
+		if SigningPublicKey == "" && !RequireSigned {
+			log.Printf("WARNING: can't verify %s: %s\n", a.Name, err)
+			return nil
+		}
+		return err
+	}
+	log.Printf("OK: %s is signed\n", a.Name)
+	return nil
+}
+
+func removeDownload(binary string) {
+	os.Remove(binary)
+	os.Remove(signaturePath(binary))
+}
+
+// Upgrade installs the latest release if its newer than us (or force is set).
+// It returns true if a new binary was installed, and the service needs restarting.
+func Upgrade(force bool) (bool, error) {
+	r, err := LatestRelease()
+	if err != nil {
+		return false, err
+	}
+	if IsDevelopment(Version) && !force {
+		return false, fmt.Errorf("can't compare development build %s with %s, use --force to install it anyway", Version, r.TagName)
+	}
+	newer, err := CompareVersions(r.TagName, Version)
+	if err != nil && !force {
+		return false, err
+	}
+	if err == nil && newer <= 0 && !force {
+		log.Printf("OK: %s is up to date (latest release is %s)\n", Version, r.TagName)
+		return false, nil
+	}
+	log.Printf("Upgrading from %s to %s\n", Version, r.TagName)
+
+	binary, err := Download(r)
+	if err != nil {
+		return false, err
+	}
+	defer removeDownload(binary)
+	// trust what the binary says it is over the release's tag
+	info, err := BinaryVersion(binary)
+	if err != nil {
+		return false, err
+	}
+	if info.Version != r.TagName {
+		log.Printf("WARNING: release %s contains cirrid %s\n", r.TagName, info.Version)
+	}
+	if err := installBinary(binary, info.Version); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateStatus is the result of the last check for a newer release
+type UpdateStatus struct {
+	Checked   time.Time
+	Current   string
+	Latest    string `json:",omitempty"`
+	Available bool
+	Error     string `json:",omitempty"`
+}
+
+// CheckForUpdate looks for a release newer than us
+func CheckForUpdate() UpdateStatus {
+	status := UpdateStatus{
+		Checked: time.Now(),
+		Current: Version,
+	}
+	r, err := LatestRelease()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Latest = r.TagName
+	if IsDevelopment(Version) {
+		status.Error = fmt.Sprintf("can't compare development build %s", Version)
+		return status
+	}
+	newer, err := CompareVersions(r.TagName, Version)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Available = newer > 0
+	return status
+}
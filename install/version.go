@@ -0,0 +1,70 @@
+package install
+
+// the version contract: `cirrid version --json` prints VersionInfo, which is how
+// install and upgrade find out what an installed binary is
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// VersionInfo is what `cirrid version` reports
+type VersionInfo struct {
+	Version   string
+	Commit    string
+	BuildTime string
+	GoVersion string
+	Platform  string
+}
+
+// Info describes the running binary
+func Info() VersionInfo {
+	return VersionInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// IsDevelopment is true for versions that can't be compared: local and -dirty builds
+func IsDevelopment(v string) bool {
+	return strings.Contains(v, "DEVELOPMENT") || strings.Contains(v, "-dirty")
+}
+
+// CompareVersions returns -1, 0 or 1 as a is older, the same as, or newer than b
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, fmt.Errorf("can't compare version %q: %s", a, err)
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, fmt.Errorf("can't compare version %q: %s", b, err)
+	}
+	return va.Compare(vb), nil
+}
+
+// BinaryVersion asks the cirrid binary at path what version it is
+func BinaryVersion(path string) (VersionInfo, error) {
+	var info VersionInfo
+	out, _, err := util.RunLocally(util.Options{}, path, "version", "--json")
+	if err != nil {
+		return info, fmt.Errorf("%s version: %s", path, err)
+	}
+	if err := json.Unmarshal([]byte(out), &info); err == nil && info.Version != "" {
+		return info, nil
+	}
+	// older releases ignore the flags, and just print the version
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	info.Version = strings.TrimSpace(lines[len(lines)-1])
+	if info.Version == "" {
+		return info, fmt.Errorf("%s version: no output", path)
+	}
+	return info, nil
+}
@@ -0,0 +1,139 @@
+package install
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/onaci/cirrid/util"
+)
+
+func TestBinaryVersionJSON(t *testing.T) {
+	fake := &util.FakeExecutor{}
+	defer util.UseExecutor(fake)()
+	fake.Expect("/usr/local/bin/cirrid", "version", "--json").
+		Returns(`{"Version": "v0.2021.05.20.120000", "Commit": "abc123", "Platform": "linux/amd64"}`)
+
+	info, err := BinaryVersion("/usr/local/bin/cirrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "v0.2021.05.20.120000" || info.Commit != "abc123" {
+		t.Errorf("got %+v", info)
+	}
+	if unmet := fake.Unmet(); len(unmet) > 0 {
+		t.Errorf("not run: %q", unmet)
+	}
+}
+
+// releases from before the version contract ignore --json, and print the version last
+func TestBinaryVersionOldRelease(t *testing.T) {
+	fake := &util.FakeExecutor{}
+	defer util.UseExecutor(fake)()
+	fake.Expect("/usr/local/bin/cirrid", "version", "--json").
+		Returns("2021/05/20 12:00:00 some logging\nv0.2021.05.20.120000\n")
+
+	info, err := BinaryVersion("/usr/local/bin/cirrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "v0.2021.05.20.120000" {
+		t.Errorf("got version %q", info.Version)
+	}
+}
+
+func TestBinaryVersionFails(t *testing.T) {
+	fake := &util.FakeExecutor{}
+	defer util.UseExecutor(fake)()
+	fake.Expect("/usr/local/bin/cirrid", "version", "--json").Fails(2, "exec format error")
+
+	if _, err := BinaryVersion("/usr/local/bin/cirrid"); err == nil {
+		t.Error("expected an error from a binary that won't run")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v0.2021.05.20.120000", "v0.2021.05.20.120000", 0},
+		{"v0.2021.05.20.120000", "v0.2021.06.01.000000", -1},
+		{"v0.2022.01.01.000000", "v0.2021.12.31.235959", 1},
+	}
+	for _, tt := range tests {
+		got, err := CompareVersions(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("CompareVersions(%q, %q): %s", tt.a, tt.b, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if _, err := CompareVersions("DEVELOPMENT", "v0.2021.05.20.120000"); err == nil {
+		t.Error("expected DEVELOPMENT not to compare")
+	}
+}
+
+// updateBinary asks the installed binary its version, and only replaces it with a newer one
+func TestUpdateBinary(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed string
+		replaced  bool
+	}{
+		{"older installed", "v0.2021.01.01.000000", true},
+		{"same installed", "v0.2021.06.01.000000", false},
+		{"newer installed", "v0.2022.01.01.000000", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			newBinary := filepath.Join(dir, "new")
+			dest := filepath.Join(dir, "cirrid")
+			if err := ioutil.WriteFile(newBinary, []byte("new"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(dest, []byte("old"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			fake := &util.FakeExecutor{}
+			defer util.UseExecutor(fake)()
+			fake.Expect(dest, "version", "--json").Returns(`{"Version": "` + tt.installed + `"}`)
+
+			if err := updateBinary(newBinary, "v0.2021.06.01.000000", dest, false); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := string(got) == "new"; replaced != tt.replaced {
+				t.Errorf("replaced = %v, want %v", replaced, tt.replaced)
+			}
+		})
+	}
+}
+
+// development builds are always installed, without asking what's there
+func TestUpdateBinaryDevelopment(t *testing.T) {
+	dir := t.TempDir()
+	newBinary := filepath.Join(dir, "new")
+	dest := filepath.Join(dir, "cirrid")
+	if err := ioutil.WriteFile(newBinary, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fake := &util.FakeExecutor{}
+	defer util.UseExecutor(fake)()
+
+	if err := updateBinary(newBinary, "DEVELOPMENT", dest, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Calls) > 0 {
+		t.Errorf("ran %q", fake.Calls)
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "new" {
+		t.Errorf("%s wasn't installed", dest)
+	}
+}
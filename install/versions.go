@@ -0,0 +1,202 @@
+package install
+
+// the versioned binaries InstallBin leaves in InstallDir, and switching between them
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InstalledVersion is one InstallDir/cirrid-VERSION binary
+type InstalledVersion struct {
+	Version string
+	Path    string
+	Active  bool
+	ModTime time.Time
+}
+
+func aliasPath() string {
+	return filepath.Join(InstallDir, "cirrid")
+}
+
+// ListVersions returns the installed versions, oldest first
+func ListVersions() ([]InstalledVersion, error) {
+	matches, err := filepath.Glob(filepath.Join(InstallDir, "cirrid-*"))
+	if err != nil {
+		return nil, err
+	}
+	active, err := os.Readlink(aliasPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if active != "" && !filepath.IsAbs(active) {
+		active = filepath.Join(InstallDir, active)
+	}
+
+	versions := []InstalledVersion{}
+	for _, path := range matches {
+		if strings.HasSuffix(path, ".sig") {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil || !stat.Mode().IsRegular() {
+			continue
+		}
+		versions = append(versions, InstalledVersion{
+			Version: strings.TrimPrefix(filepath.Base(path), "cirrid-"),
+			Path:    path,
+			Active:  path == active,
+			ModTime: stat.ModTime(),
+		})
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		vi, erri := parseVersion(versions[i].Version)
+		vj, errj := parseVersion(versions[j].Version)
+		switch {
+		case erri == nil && errj == nil:
+			return vi.LessThan(vj)
+		case erri == nil || errj == nil:
+			// DEVELOPMENT builds are newer than any release
+			return erri == nil
+		}
+		// and sort by when they were installed
+		return versions[i].ModTime.Before(versions[j].ModTime)
+	})
+	return versions, nil
+}
+
+// findVersion matches "v0.1", "0.1" or "cirrid-v0.1"
+func findVersion(versions []InstalledVersion, want string) (InstalledVersion, bool) {
+	want = strings.TrimPrefix(want, "cirrid-")
+	for _, v := range versions {
+		if v.Version == want || strings.TrimPrefix(v.Version, "v") == strings.TrimPrefix(want, "v") {
+			return v, true
+		}
+	}
+	return InstalledVersion{}, false
+}
+
+// Rollback points the cirrid link at another installed version - the one before the active one if to is empty
+func Rollback(to string) (InstalledVersion, error) {
+	if err := ensureInstallDir(); err != nil {
+		return InstalledVersion{}, err
+	}
+	versions, err := ListVersions()
+	if err != nil {
+		return InstalledVersion{}, err
+	}
+
+	var target InstalledVersion
+	if to != "" {
+		v, ok := findVersion(versions, to)
+		if !ok {
+			return target, fmt.Errorf("version %s is not installed in %s", to, InstallDir)
+		}
+		target = v
+	} else {
+		for i, v := range versions {
+			if v.Active {
+				if i == 0 {
+					return target, fmt.Errorf("%s is the oldest installed version", v.Version)
+				}
+				target = versions[i-1]
+			}
+		}
+		if target.Path == "" {
+			return target, fmt.Errorf("%s doesn't point at an installed version, say which version to use", aliasPath())
+		}
+	}
+	if target.Active {
+		log.Printf("OK: %s is already the active version\n", target.Version)
+		return target, nil
+	}
+	if RequireSigned {
+		if err := VerifySignature(target.Path); err != nil {
+			return target, fmt.Errorf("require_signed is set, refusing to use %s: %s", target.Path, err)
+		}
+	}
+	log.Printf("linking %s to %s\n", aliasPath(), target.Path)
+	if err := replaceSymlink(target.Path, aliasPath()); err != nil {
+		return target, err
+	}
+	target.Active = true
+	return target, nil
+}
+
+// Prune removes all but the newest keep versions (and never the active one), returning what it removed
+func Prune(keep int) ([]string, error) {
+	if err := ensureInstallDir(); err != nil {
+		return nil, err
+	}
+	versions, err := ListVersions()
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for i, v := range versions {
+		if v.Active || i >= len(versions)-keep {
+			continue
+		}
+		if err := os.Remove(v.Path); err != nil {
+			return removed, err
+		}
+		os.Remove(signaturePath(v.Path))
+		removed = append(removed, v.Path)
+	}
+	return removed, nil
+}
+
+// replaceSymlink atomically points link at target, by renaming a new link over it
+func replaceSymlink(target, link string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(link), ".cirrid-link-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	// we only wanted the unique name
+	if err := os.Remove(tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), link); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Uninstall removes the cirrid link, and all the installed versions, returning what it removed
+func Uninstall() ([]string, error) {
+	if err := ensureInstallDir(); err != nil {
+		return nil, err
+	}
+	versions, err := ListVersions()
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	if _, err := os.Lstat(aliasPath()); err == nil {
+		if err := os.Remove(aliasPath()); err != nil {
+			return removed, err
+		}
+		removed = append(removed, aliasPath())
+	}
+	for _, v := range versions {
+		if err := os.Remove(v.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, v.Path)
+		if err := os.Remove(signaturePath(v.Path)); err == nil {
+			removed = append(removed, signaturePath(v.Path))
+		}
+	}
+	return removed, nil
+}
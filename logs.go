@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/onaci/cirrid/control"
+)
+
+// `cirrid logs` - show the running daemon's recent log lines, and optionally keep following them
+func logsCmd(args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "keep showing new lines as they're logged")
+	lines := flags.Int("n", 50, "how many of the recent lines to show")
+	flags.Parse(args)
+
+	var logs []control.LogLine
+	if err := control.Get("/logs", &logs); err != nil {
+		return err
+	}
+	if *lines >= 0 && len(logs) > *lines {
+		logs = logs[len(logs)-*lines:]
+	}
+	var seq int64
+	for {
+		for _, l := range logs {
+			fmt.Printf("%s %-7s %s\n", l.Time.Format("2006-01-02 15:04:05"), l.Level, trimNewline(l.Text))
+			seq = l.Seq
+		}
+		if !*follow {
+			return nil
+		}
+		time.Sleep(time.Second)
+		if err := control.Get(fmt.Sprintf("/logs?since=%d", seq), &logs); err != nil {
+			return err
+		}
+	}
+}
+
+func trimNewline(s string) string {
+	for len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r') {
+		s = s[:len(s)-1]
+	}
+	return s
+}
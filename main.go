@@ -1,15 +1,21 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"github.com/onaci/cirrid/acme"
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/control"
 	"github.com/onaci/cirrid/dns"
 	"github.com/onaci/cirrid/install"
+	"github.com/onaci/cirrid/proxy"
+	"github.com/onaci/cirrid/remote"
+	"github.com/onaci/cirrid/util"
 
 	"github.com/kardianos/service"
 
@@ -34,16 +40,183 @@ ask_cirri = true
 # also set current hostname + zone = magic
 use_hostname = true
 
+# more zones can be added with [zone "name"] sections (settings: ttl, wildcard, use_hostname,
+# ask_cirri, forward = upstream DNS servers), and their hosts listed in [hosts "name"]
+
+# other record types go in [records] (or [records "name"]), in zone file syntax,
+# with names relative to the zone, and repeated keys for more than one record:
+#   www.example = CNAME example
+#   _acme-challenge.example = TXT "stand-in"
+#   _http._tcp.example = SRV 0 5 8080 example
+#   example = MX 10 mail.example
+
+# the 'magic' address is found by trying these strategies in order:
+#   context (the docker host, when 'cirrid context use' picked a remote one),
+#   bridge (docker default bridge gateway), network:NAME (gateway of a named docker network),
+#   published (host IP the cirri container publishes its ports on), route (default route
+#   interface address), loopback (the loopback alias)
+# magic = context, bridge, published, route, loopback
+
+# names cirrid doesn't have (which only clients that skip the host resolver, like DoH, ask about),
+# other than those below its own names, are asked of these DNS servers - system is the ones in /etc/resolv.conf
+# upstream = system
+
 [hosts]
 # list of hostname to IP address
-# *.hostname.zone will be set to the same as hostname.zone, unless you also specify ".hostname=IP"
+# *.hostname.zone will be set to the same as hostname.zone, unless you also specify "*.hostname = IP",
+# or turn it off with "hostname = IP, nowildcard" (or "wildcard = false" for the whole zone)
+# wildcards match any depth: *.hostname.zone answers for a.b.hostname.zone too
 # instead of IP address, you can use the name of the network interface to use, or the string 'magic', which will try to "just work"
 example = magic
 
+# a remote docker/cirri host, reached with ssh (as root, so using root's ~/.ssh/config and keys):
+# its cirri STACKDOMAIN (and running containers, as CONTAINER.STACKDOMAIN) are published in the zone,
+# pointing at the remote host's address (or address = IP), and refreshed every refresh interval
+# [remote "beefy"]
+# host = me@beefy.example.com
+# zone = ona.im
+# address =
+# refresh = 1m
+# containers = true
+
+# ssh port forwards from a loopback address here (127.0.1.N, or address = ) to ports on the remote end,
+# for when they aren't reachable directly - the tunnel's name is published pointing at that address
+# [tunnel "db.beefy"]
+# remote = beefy    (or host = ssh destination)
+# ports = 5432, 8080:80
+# to = localhost
+
+# keep a local dir pushed to a path on a remote host (add them with 'cirrid volumes add'),
+# files changed there as well as here since the last sync are reported as conflicts, and not pushed
+# [volume "src"]
+# remote = beefy    (or host = ssh destination)
+# local = /home/me/src
+# path = /home/me/src
+# exclude = .git, node_modules
+
+[proxy]
+# a reverse proxy on the magic address, routing by host name to the [routes] below,
+# and (with docker = true) to the running containers by name: https://grafana.HOSTNAME.ZONE goes to the
+# port the grafana container publishes (its cirrid.port label, or 80, 8080, or its lowest)
+enable = false
+listen = magic
+http = 80
+https = 443
+# certificate and key files for https, or cert = ca to have the local CA issue them
+cert =
+key =
+docker = true
+
+[routes]
+# host name (relative to the zone, unless it ends in '.') = port on the magic address, host:port, or a URL
+# grafana.example = 3000
+
+[ca]
+# the local CA, made the first time a cert is asked for ('sudo cirrid ca trust' adds it to the system's trusted roots)
+dir = /etc/cirrid/ca
+# certs from 'cirrid ca cert' are written (and renewed) here, with ca.crt, for containers to mount
+certs = /etc/cirrid/certs
+lifetime = 168h
+
+[secure_dns]
+# DNS-over-HTTPS (https://NAME.ZONE:DOH/dns-query) and DNS-over-TLS (NAME.ZONE:DOT) listeners,
+# for the browsers and containers that skip the host resolver (NAME is published pointing at the listen address)
+enable = false
+listen = magic
+name = dns
+# 0 to turn either off
+doh = 8053
+dot = 853
+# certificate and key files, or cert = ca to have the local CA issue them
+cert = ca
+key =
+
+[cache]
+# answers from upstream (and zone forward servers) are kept for their TTL, up to max_ttl,
+# and 'no such name' answers for their SOA's negative TTL; 'sudo cirrid cache flush' empties it
+# how many answers to keep, 0 turns the cache off
+size = 10000
+max_ttl = 24h
+# ask again for names that keep being looked up, just before they expire
+prefetch = true
+
+[acme]
+# an ACME server for the local CA, so Traefik, Caddy etc can get certs for cirrid's names:
+# its directory is https://NAME.ZONE:PORT/directory (NAME is published pointing at the listen address),
+# dns-01 TXT records can be added through https://NAME.ZONE:PORT/httpreq (lego's httpreq provider,
+# with username acme and the password cirrid writes to DIR/httpreq.secret)
+enable = false
+listen = magic
+port = 14000
+name = acme
+# accounts are kept here
+dir = /etc/cirrid/acme
+
+[docker]
+# the docker context cirrid's own docker commands (and so the magic address) follow - set by 'cirrid context use'
+context =
+host =
+
+[install]
+# only install (or upgrade to) binaries signed with the release key
+require_signed = false
+
+[update]
+# where to look for new releases - anything that speaks the GitHub releases api
+url = https://api.github.com/repos/onaci/cirrid
+# also upgrade to releases marked as prereleases
+prerelease = false
+# check for new releases every interval
+check = true
+interval = 6h
+# and install them in the maintenance window (local time, eg 02:00-04:00, empty for any time)
+auto_apply = false
+window =
+
+[metrics]
+# also serve prometheus /metrics on this address (eg 127.0.0.1:9858)
+listen =
+
 `
 
+// loadCfgFile reads the cfg file, filling in anything it doesn't set from the defaults
+// (loading both as sources would make the file's values shadows of the defaults, and records need AllowShadows)
+func loadCfgFile() (*ini.File, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true, AllowShadows: true}, globalCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := ini.Load([]byte(defaultCfg))
+	if err != nil {
+		return nil, err
+	}
+	for _, dsec := range defaults.Sections() {
+		sec, err := cfg.GetSection(dsec.Name())
+		if err != nil {
+			if sec, err = cfg.NewSection(dsec.Name()); err != nil {
+				return nil, err
+			}
+			sec.Comment = dsec.Comment
+		}
+		for _, dkey := range dsec.Keys() {
+			if sec.HasKey(dkey.Name()) {
+				continue
+			}
+			key, err := sec.NewKey(dkey.Name(), dkey.Value())
+			if err != nil {
+				return nil, err
+			}
+			key.Comment = dkey.Comment
+		}
+	}
+	return cfg, nil
+}
+
 func ensureCfgFile() (*ini.File, error) {
-	cfg, err := ini.LooseLoad([]byte(defaultCfg), globalCfgFile)
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return nil, err
+	}
 
 	logger.Infof("Ensuring there's a cfg file at %s", globalCfgFile)
 
@@ -82,52 +255,62 @@ func (p *program) run() error {
 	logger.Infof("I'm running %v using exec: %s, which is actually file %s.", service.Platform(), os.Args[0], realPath)
 	dns.SetLogger(logger)
 
-	//dns.SetDNSValues()
-	if cfg.Section("").Key("ask_cirri").MustBool(true) {
-		stackdomain := dns.GetCirriStackdomain()
-		if stackdomain != "" {
-			dns.SetDNSValue(
-				stackdomain,
-				cfg.Section("").Key("zone").String(),
-				"magic",
-			)
+	contextName, dockerHost := readDockerContext(cfg)
+	setCurrentContext(contextName)
+	util.SetDockerHost(dockerHost)
+	if order := cfg.Section("").Key("magic").String(); order != "" {
+		if err := dns.SetMagicOrder(order); err != nil {
+			logger.Errorf("Ignoring magic setting: %s\n", err)
 		}
 	}
 
-	if cfg.Section("").Key("use_hostname").MustBool(true) {
-		dns.SetDNSValue(
-			dns.GetHostname(),
-			cfg.Section("").Key("zone").String(),
-			"magic",
-		)
-	}
-
-	for _, key := range cfg.Section("hosts").Keys() {
-		dns.SetDNSValue(
-			key.Name(),
-			cfg.Section("").Key("zone").String(),
-			key.MustString("magic"),
-		)
-	}
-
-	dns.EnsureWildCards()
+	configureDNS(cfg)
+	remotes := readRemotes(cfg)
+	remote.Start(remotes, readTunnels(cfg, remotes), logger)
+	remote.SyncVolumes(readVolumes(cfg, remotes))
 
-	dns.EnsureResolveConfigured(logger)
-	time.Sleep(100 * time.Millisecond)
-	go dns.DnsServer(logger)
-	time.Sleep(100 * time.Millisecond)
-	dns.ResetHostServices(logger)
+	// remote hosts found meanwhile wait for this, then restart the resolver themselves if they add routing domains
+	dns.WithResolverLock(func() {
+		dns.EnsureResolveConfigured(logger)
+		time.Sleep(100 * time.Millisecond)
+		go dns.DnsServer(logger)
+		time.Sleep(100 * time.Millisecond)
+		dns.ResetHostServices(logger)
+	})
 
-	ticker := time.NewTicker(6 * time.Hour)
-	for {
-		select {
-		case tm := <-ticker.C:
-			logger.Infof("Still running at %v...", tm)
-		case <-p.exit:
-			ticker.Stop()
-			return nil
+	registerStatusHandler()
+	registerQueryHandler()
+	registerVolumeHandlers()
+	registerContextHandlers()
+	ca.Configure(readCA(cfg), logger)
+	registerCAHandlers()
+	registerCacheHandlers()
+	go ca.KeepRenewed()
+	if secure, enabled, err := readSecureDNS(cfg); err != nil {
+		logger.Errorf("DoH and DoT not started: %s\n", err)
+	} else if enabled {
+		if err := dns.ServeSecure(secure); err != nil {
+			logger.Errorf("DoH and DoT not started: %s\n", err)
+		}
+	}
+	if acmeCfg, enabled := readACME(cfg); enabled {
+		if err := acme.Start(acmeCfg, logger); err != nil {
+			logger.Errorf("ACME server not started: %s\n", err)
+		}
+	}
+	if proxyCfg, enabled := readProxy(cfg); enabled {
+		if err := proxy.Start(proxyCfg, logger); err != nil {
+			logger.Errorf("Proxy not started: %s\n", err)
 		}
 	}
+	go control.Serve(logger)
+
+	configureInstall(cfg)
+	if address := cfg.Section("metrics").Key("listen").String(); address != "" {
+		go control.ServeMetrics(logger, address)
+	}
+	checkForUpdates(readUpdateSchedule(cfg), p.exit)
+	return nil
 }
 func (p *program) Stop(s service.Service) error {
 	// Any work in Stop should be quick, usually a few seconds at most.
@@ -143,10 +326,13 @@ func (p *program) Stop(s service.Service) error {
 //   Handle service controls (optional).
 //   Run the service.
 func main() {
+	var args []string
+	args, useSudo = takeSudoFlag(os.Args[1:])
+	os.Args = append(os.Args[:1], args...)
 	if len(os.Args) < 2 {
 		// TODO: if os.Arg[1] not in
 		// TODO: add upgrade and version
-		fmt.Printf("Valid cmdline: %s %q\n", os.Args[0], service.ControlAction)
+		fmt.Printf("Valid cmdline: %s %q\n", os.Args[0], append(service.ControlAction[:], "run", "install", "uninstall", "upgrade", "versions", "rollback", "status", "logs", "query", "volumes", "context", "ca", "cache", "doctor", "version", "sign"))
 		//		fmt.Printf("Valid cmdline: %q\n", append(service.ControlAction, "run", "upgrade", "version"))
 		return
 	}
@@ -176,6 +362,8 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// keep recent lines for `cirrid logs`
+	logger = control.TeeLogger(logger)
 
 	// TODO: detect if its installed or not, and tell the user if that's why it failed to stop/start/restart
 	go func() {
@@ -187,34 +375,102 @@ func main() {
 		}
 	}()
 
+	if needsPrivileges(os.Args[1:]) {
+		requirePrivileges(os.Args[1])
+	}
+
 	switch os.Args[1] {
 	case "version":
-		fmt.Printf("%s\n", install.Version)
+		if err := versionCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "versions":
+		if err := versionsCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "rollback":
+		if err := rollbackCmd(s, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "uninstall":
+		if err := uninstallCmd(s, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "sign":
+		if err := signCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "doctor":
+		if err := doctorCmd(s, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		if err := statusCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "logs":
+		if err := logsCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "context":
+		if err := contextCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "ca":
+		if err := caCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "cache":
+		if err := cacheCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "volumes":
+		if err := volumesCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "query":
+		if err := queryCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
 	case "run":
 		err = s.Run()
 		if err != nil {
 			logger.Error(err)
 		}
 	case "upgrade":
-		log.Printf("UPGRADE: not implemented yet\n")
-		// TODO: check for sudo / root
+		if err := upgradeCmd(s, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
 	case "install":
+		flags := flag.NewFlagSet("install", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only show what would be installed")
+		flags.Parse(os.Args[2:])
+		install.SetDryRun(*dryRun)
+
 		log.Printf("installing:\n")
-		// TODO: check for sudo / root
 		// copy to /usr/local/bin/cirrid-VERSION
 		// make softlink to /usr/local/bin/cirrid
-		err := install.InstallBin()
-		if err != nil {
-			log.Fatal(err)
+		var cfg *ini.File
+		if *dryRun {
+			cfg, err = loadCfgFile()
+		} else {
+			cfg, err = ensureCfgFile()
 		}
-		_, err = ensureCfgFile()
 		if err != nil {
 			fmt.Printf("Fail to read /etc/cirrid.ini file: %v", err)
 			os.Exit(1)
 		}
-		// TODO: see if the service is already there, and if its definition is up to date...
-		err = service.Control(s, "install")
-		if err != nil && !strings.Contains(err.Error(), "Init already exists") {
+		configureInstall(cfg)
+		err = install.InstallBin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dryRun {
+			log.Printf("DryRun - install and restart the %s service\n", svcConfig.Name)
+			return
+		}
+		err = ensureService(s, svcConfig)
+		if err != nil {
 			log.Fatal(err)
 		}
 		log.Printf("Start service:\n")
@@ -222,8 +478,11 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		ca.Configure(readCA(cfg), logger)
+		if !ca.Exists() || !ca.IsTrusted() {
+			log.Printf("To have this machine trust the certs from cirrid's local CA, run 'sudo cirrid ca trust'\n")
+		}
 	default:
-		// TODO: check for sudo / root
 		err := service.Control(s, os.Args[1])
 		if err != nil {
 			log.Printf("Valid actions: %q\n", service.ControlAction)
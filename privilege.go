@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// commands that change the system need root - the read only ones (status, logs, query, doctor, version, versions)
+// ask the running daemon over the control socket instead, and sign only touches the files it's given;
+// subcommands that change things (like 'ca trust' or 'cache flush') call requirePrivileges themselves
+var privilegedCommands = map[string]bool{
+	"run":       true,
+	"install":   true,
+	"uninstall": true,
+	"upgrade":   true,
+	"rollback":  true,
+}
+
+// the privileged commands that take --dry-run, which only looks so doesn't need root
+var dryRunCommands = map[string]bool{
+	"install": true,
+}
+
+// set by --sudo (anywhere on the cmdline): re-run with sudo/pkexec instead of failing
+var useSudo bool
+
+func init() {
+	for _, action := range service.ControlAction {
+		privilegedCommands[action] = true
+	}
+}
+
+// needsPrivileges says if the cmdline needs root - only looking, like install --dry-run, doesn't
+func needsPrivileges(args []string) bool {
+	if !privilegedCommands[args[0]] {
+		return false
+	}
+	if !dryRunCommands[args[0]] {
+		return true
+	}
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--dry-run", "-dry-run", "--dry-run=true", "-dry-run=true":
+			return false
+		}
+	}
+	return true
+}
+
+// takeSudoFlag removes --sudo from args, and says if it was there
+func takeSudoFlag(args []string) ([]string, bool) {
+	found := false
+	rest := []string{}
+	for _, arg := range args {
+		if arg == "--sudo" || arg == "-sudo" {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+// requirePrivileges makes sure we're root, re-running the whole command with sudo if --sudo was given,
+// and otherwise exits telling the user how
+func requirePrivileges(command string) {
+	if util.IsPrivileged() {
+		return
+	}
+	if useSudo {
+		err := util.Elevate(os.Args[1:])
+		log.Fatalf("'cirrid %s' needs root: %s\n", command, err)
+	}
+	log.Fatalf("'cirrid %s' needs root: run 'sudo cirrid %s', or add --sudo\n", command, strings.Join(os.Args[1:], " "))
+}
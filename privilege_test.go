@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNeedsPrivileges(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    bool
+	}{
+		{"install", true},
+		{"install --dry-run", false},
+		{"install -dry-run=true", false},
+		// upgrade and rollback don't take --dry-run, so it doesn't get them out of needing root
+		{"upgrade --dry-run", true},
+		{"rollback --dry-run", true},
+		{"status", false},
+		{"query --dry-run host.ona.im", false},
+	}
+	for _, tt := range tests {
+		if got := needsPrivileges(strings.Fields(tt.cmdline)); got != tt.want {
+			t.Errorf("needsPrivileges(%q) = %v, want %v", tt.cmdline, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+// routes to running containers: each one's name (swarm task names just keep the service part)
+// goes to the port it publishes - the one in its cirrid.port label, or 80, 8080, or its lowest.
+// A cirrid.name label gives it a different name.
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/util"
+)
+
+// container name -> target, guarded by routeLock
+var containers = map[string]*url.URL{}
+var lastRefresh time.Time
+
+const containerRefresh = 30 * time.Second
+
+func watchContainers() {
+	for {
+		refreshContainers(0)
+		time.Sleep(containerRefresh)
+	}
+}
+
+type dockerContainer struct {
+	Name   string
+	Config struct {
+		Labels map[string]string
+	}
+	NetworkSettings struct {
+		Ports map[string][]struct {
+			HostIp   string
+			HostPort string
+		}
+	}
+}
+
+// refreshContainers asks docker for the running containers' ports, unless it was asked in the last minAge
+func refreshContainers(minAge time.Duration) bool {
+	routeLock.Lock()
+	if time.Since(lastRefresh) < minAge {
+		routeLock.Unlock()
+		return false
+	}
+	lastRefresh = time.Now()
+	routeLock.Unlock()
+
+	ids, _, err := util.RunDocker(util.Options{}, "ps", "-q")
+	if err != nil {
+		logger.Warningf("Proxy can't list containers: %s\n", err)
+		return false
+	}
+	found := map[string]*url.URL{}
+	if strings.TrimSpace(ids) != "" {
+		out, _, err := util.RunDocker(util.Options{}, append([]string{"inspect"}, strings.Fields(ids)...)...)
+		if err != nil {
+			logger.Warningf("Proxy can't inspect containers: %s\n", err)
+			return false
+		}
+		var list []dockerContainer
+		if err := json.Unmarshal([]byte(out), &list); err != nil {
+			logger.Warningf("Proxy can't read docker inspect: %s\n", err)
+			return false
+		}
+		for _, c := range list {
+			if name, target := containerRoute(c); target != nil {
+				found[name] = target
+			}
+		}
+	}
+
+	routeLock.Lock()
+	containers = found
+	routeLock.Unlock()
+	return true
+}
+
+func containerRoute(c dockerContainer) (string, *url.URL) {
+	name := c.Config.Labels["cirrid.name"]
+	if name == "" {
+		name = strings.TrimPrefix(c.Name, "/")
+		name = strings.SplitN(name, ".", 2)[0]
+		name = strings.Replace(name, "_", "-", -1)
+	}
+	name = strings.ToLower(name)
+
+	type published struct {
+		port     int
+		hostIP   string
+		hostPort string
+	}
+	ports := []published{}
+	for spec, bindings := range c.NetworkSettings.Ports {
+		parts := strings.SplitN(spec, "/", 2)
+		if len(parts) == 2 && parts[1] != "tcp" {
+			continue
+		}
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || len(bindings) == 0 {
+			continue
+		}
+		ports = append(ports, published{port: port, hostIP: bindings[0].HostIp, hostPort: bindings[0].HostPort})
+	}
+	if len(ports) == 0 {
+		return name, nil
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].port < ports[j].port })
+	chosen := ports[0]
+	wanted := []string{c.Config.Labels["cirrid.port"], "80", "8080"}
+	for i := len(wanted) - 1; i >= 0; i-- {
+		for _, p := range ports {
+			if strconv.Itoa(p.port) == wanted[i] {
+				chosen = p
+			}
+		}
+	}
+
+	host := chosen.hostIP
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = dockerHostAddress()
+	}
+	return name, &url.URL{Scheme: "http", Host: net.JoinHostPort(host, chosen.hostPort)}
+}
+
+// where ports published on all addresses can be reached: here, or the remote docker host
+func dockerHostAddress() string {
+	if remote, _ := util.RemoteDockerHost(util.DockerHost()); remote != "" {
+		return dns.GetMagic().Address
+	}
+	return "127.0.0.1"
+}
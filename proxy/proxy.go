@@ -0,0 +1,215 @@
+package proxy
+
+// an optional reverse proxy on the magic address, so https://grafana.host.ona.im goes to
+// whichever port the grafana container publishes, without every stack running its own Traefik.
+// Requests are routed by their Host: first the [routes] from the cfg file, then the running
+// containers, by name (the first label of the host name).
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+)
+
+// Config is the [proxy] section from the cfg file
+type Config struct {
+	// the address to listen on, "magic" for the magic address
+	Listen    string
+	HTTPPort  int
+	HTTPSPort int
+	// TLS certificate and key files for the https listener, or "ca" for certs from the local CA
+	CertFile string
+	KeyFile  string
+	// also route to running containers
+	Docker bool
+	// full host name -> target (host:port, or a URL)
+	Routes map[string]string
+}
+
+// Route is where requests for a host name go
+type Route struct {
+	Host   string
+	Target string
+	Source string
+}
+
+var logger service.Logger
+var config Config
+var routeLock sync.RWMutex
+var configured = map[string]*url.URL{}
+
+// Start runs the proxy's http (and https, if it has a certificate) listeners in the background
+func Start(c Config, l service.Logger) error {
+	logger = l
+	config = c
+
+	routeLock.Lock()
+	for host, target := range c.Routes {
+		u, err := parseTarget(target)
+		if err != nil {
+			routeLock.Unlock()
+			return fmt.Errorf("route %s: %s", host, err)
+		}
+		configured[strings.ToLower(strings.TrimSuffix(host, "."))] = u
+	}
+	routeLock.Unlock()
+
+	address := c.Listen
+	if address == "" || address == "magic" {
+		address = dns.GetMagic().Address
+	}
+	handler := &httputil.ReverseProxy{
+		Director:     direct,
+		ErrorHandler: proxyError,
+	}
+	if c.Docker {
+		go watchContainers()
+	}
+
+	if c.HTTPPort > 0 {
+		srv := &http.Server{Addr: net.JoinHostPort(address, strconv.Itoa(c.HTTPPort)), Handler: withRoute(handler)}
+		logger.Infof("Proxy listening on http://%s\n", srv.Addr)
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				logger.Errorf("Proxy http listener stopped: %s\n", err)
+			}
+		}()
+	}
+	if c.HTTPSPort > 0 && c.CertFile != "" {
+		tlsConfig := &tls.Config{GetCertificate: ca.GetCertificate}
+		if c.CertFile != "ca" {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return fmt.Errorf("proxy certificate: %s", err)
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		srv := &http.Server{
+			Addr:      net.JoinHostPort(address, strconv.Itoa(c.HTTPSPort)),
+			Handler:   withRoute(handler),
+			TLSConfig: tlsConfig,
+		}
+		logger.Infof("Proxy listening on https://%s\n", srv.Addr)
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != nil {
+				logger.Errorf("Proxy https listener stopped: %s\n", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// parseTarget takes host:port (or just a port, on the magic address) or a URL
+func parseTarget(target string) (*url.URL, error) {
+	if !strings.Contains(target, "://") {
+		if _, err := strconv.Atoi(target); err == nil {
+			target = net.JoinHostPort(dns.GetMagic().Address, target)
+		}
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %q", target)
+	}
+	return u, nil
+}
+
+type routeKey struct{}
+
+// withRoute finds the request's route before handing it to the proxy, so unknown hosts get a clear 502
+func withRoute(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(host, ".")
+		target := findRoute(host)
+		if target == nil {
+			control.AddCounter("cirrid_proxy_requests_total", "Requests through the proxy, by result", 1, "result", "no_route")
+			http.Error(w, fmt.Sprintf("cirrid proxy: no route for %s", host), http.StatusBadGateway)
+			return
+		}
+		control.AddCounter("cirrid_proxy_requests_total", "Requests through the proxy, by result", 1, "result", "proxied")
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			r.Header.Set("X-Forwarded-Proto", "http")
+		}
+		r.URL.Scheme = target.Scheme
+		r.URL.Host = target.Host
+		if target.Path != "" && target.Path != "/" {
+			r.URL.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// the route is already in r.URL, the Host header stays what the client asked for
+func direct(r *http.Request) {
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to the default value
+		r.Header.Set("User-Agent", "")
+	}
+}
+
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Warningf("Proxy %s%s -> %s: %s\n", r.Host, r.URL.Path, r.URL.Host, err)
+	control.AddCounter("cirrid_proxy_requests_total", "Requests through the proxy, by result", 1, "result", "error")
+	http.Error(w, fmt.Sprintf("cirrid proxy: %s is not answering: %s", r.URL.Host, err), http.StatusBadGateway)
+}
+
+// findRoute looks for the host in the configured routes, then the containers by the host's first label
+func findRoute(host string) *url.URL {
+	routeLock.RLock()
+	if u, ok := configured[host]; ok {
+		routeLock.RUnlock()
+		return u
+	}
+	name := strings.SplitN(host, ".", 2)[0]
+	u, ok := containers[name]
+	routeLock.RUnlock()
+	if ok || !config.Docker {
+		return u
+	}
+	// it may have just started
+	if refreshContainers(time.Second) {
+		routeLock.RLock()
+		u = containers[name]
+		routeLock.RUnlock()
+	}
+	return u
+}
+
+// Routes lists where the proxy sends each host, sorted by host
+func Routes() []Route {
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+	routes := []Route{}
+	for host, u := range configured {
+		routes = append(routes, Route{Host: host, Target: u.String(), Source: "config"})
+	}
+	for name, u := range containers {
+		routes = append(routes, Route{Host: name + ".*", Target: u.String(), Source: "docker"})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Host < routes[j].Host })
+	return routes
+}
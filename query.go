@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+)
+
+func registerQueryHandler() {
+	// /query?name=NAME&type=TYPE
+	control.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		result, err := dns.Query(r.URL.Query().Get("name"), r.URL.Query().Get("type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		control.WriteJSON(w, result)
+	})
+}
+
+// `cirrid query NAME [TYPE]` - ask the running daemon what it answers for NAME
+// (an IP address asks for its PTR), from its own records - names it would forward are REFUSED
+func queryCmd(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output the raw answer json")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: cirrid query [--json] NAME [TYPE]")
+	}
+	params := url.Values{}
+	params.Set("name", flags.Arg(0))
+	params.Set("type", flags.Arg(1))
+
+	var result dns.QueryResult
+	if err := control.Get("/query?"+params.Encode(), &result); err != nil {
+		return err
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	authoritative := ""
+	if result.Authoritative {
+		authoritative = ", authoritative"
+	}
+	fmt.Printf("%s %s: %s%s\n", result.Name, result.Type, result.Rcode, authoritative)
+	for _, rr := range result.Answer {
+		fmt.Printf("  %s\n", rr)
+	}
+	if len(result.Extra) > 0 {
+		fmt.Printf("additional:\n")
+		for _, rr := range result.Extra {
+			fmt.Printf("  %s\n", rr)
+		}
+	}
+	return nil
+}
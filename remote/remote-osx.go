@@ -0,0 +1,19 @@
+// +build darwin
+
+package remote
+
+import (
+	"fmt"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// only 127.0.0.1 is on lo0 by default, the tunnel addresses need adding
+func ensureLoopbackAlias(address string) error {
+	// sudo ifconfig lo0 alias 127.0.1.1
+	_, stderr, err := util.RunLocally(util.Options{}, "ifconfig", "lo0", "alias", address)
+	if err != nil {
+		return fmt.Errorf("ifconfig lo0 alias %s: %s %s", address, err, stderr)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package remote
+
+// remote cirri hosts: a docker host somewhere else, that we talk to with ssh (util.RunOn),
+// so developers can run their stack on a beefy box and still use the same names.
+// We ask it for its cirri STACKDOMAIN and running containers, publish names for them
+// that point at the remote host, and keep doing that every refresh interval.
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/util"
+)
+
+// Host is a [remote "name"] section from the cfg file
+type Host struct {
+	Name string
+	// ssh destination, eg me@beefy.example.com, or a Host from ~/.ssh/config
+	SSH  string
+	Zone string
+	// what the names point at - empty means the ssh host's own address
+	Address    string
+	Refresh    time.Duration
+	Containers bool
+}
+
+// State is what we last found out about a remote host
+type State struct {
+	Name        string
+	SSH         string
+	Address     string
+	Stackdomain string
+	Containers  []string
+	Names       []string
+	Refreshed   time.Time
+	Error       string `json:",omitempty"`
+}
+
+const DefaultRefresh = time.Minute
+
+var logger service.Logger
+var stateLock sync.Mutex
+var states = map[string]*State{}
+
+// Start keeps the records for each remote host fresh, and the tunnels running, in the background.
+// Tunnel names are published first, so they win over the same name found on a remote host.
+func Start(hosts []Host, tunnels []Tunnel, l service.Logger) {
+	logger = l
+	for _, t := range tunnels {
+		startTunnel(t)
+	}
+	for _, h := range hosts {
+		stateLock.Lock()
+		states[h.Name] = &State{Name: h.Name, SSH: h.SSH}
+		stateLock.Unlock()
+		go watch(h)
+	}
+}
+
+// Status returns what we know about each remote host, sorted by name
+func Status() []State {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	list := []State{}
+	for _, s := range states {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func watch(h Host) {
+	if h.Refresh <= 0 {
+		h.Refresh = DefaultRefresh
+	}
+	for {
+		refresh(h)
+		time.Sleep(h.Refresh)
+	}
+}
+
+// refresh asks the remote host what it's running, and republishes its names.
+// If the host can't be reached, the names we had stay, they're most likely still right.
+func refresh(h Host) {
+	state, err := discover(h)
+
+	stateLock.Lock()
+	old := *states[h.Name]
+	if err != nil {
+		states[h.Name].Error = err.Error()
+		states[h.Name].Refreshed = state.Refreshed
+	}
+	stateLock.Unlock()
+	if err != nil {
+		logger.Warningf("remote %s: %s\n", h.Name, err)
+		return
+	}
+
+	if !reflect.DeepEqual(old.Names, state.Names) || old.Address != state.Address {
+		logger.Infof("remote %s: publishing %s at %s\n", h.Name, strings.Join(state.Names, ", "), state.Address)
+		if err := publish(h, state); err != nil {
+			logger.Errorf("remote %s: %s\n", h.Name, err)
+			state.Error = err.Error()
+		}
+	}
+	stateLock.Lock()
+	states[h.Name] = &state
+	stateLock.Unlock()
+}
+
+func publish(h Host, state State) error {
+	return publishNames("remote "+h.Name, h.Zone, state.Names, state.Address)
+}
+
+// publishNames publishes names at address, restarting the host resolver if they need new routing domains
+func publishNames(source, zone string, names []string, address string) error {
+	hosts := []dns.Host{}
+	for _, name := range names {
+		hosts = append(hosts, dns.Host{Name: name, Address: address})
+	}
+	return dns.UpdateRouting(logger, func() error {
+		return dns.Publish(source, zone, hosts)
+	})
+}
+
+func discover(h Host) (State, error) {
+	state := State{Name: h.Name, SSH: h.SSH, Refreshed: time.Now(), Names: []string{}}
+
+	address, err := hostAddress(h)
+	if err != nil {
+		return state, err
+	}
+	state.Address = address
+
+	out, err := run(h, "docker", "inspect", "cirri")
+	if err != nil {
+		return state, fmt.Errorf("docker inspect cirri: %s", err)
+	}
+	stackdomain, err := dns.ParseStackdomain(out)
+	if err != nil {
+		return state, fmt.Errorf("docker inspect cirri: %s", err)
+	}
+	state.Stackdomain = stackdomain
+	// without a STACKDOMAIN, the remote's own name will do
+	base := stackdomain
+	if base == "" {
+		base = h.Name
+	}
+	state.Names = append(state.Names, base)
+
+	if h.Containers {
+		out, err := run(h, "docker", "ps", "--format", "{{.Names}}")
+		if err != nil {
+			return state, fmt.Errorf("docker ps: %s", err)
+		}
+		state.Containers = containerNames(out)
+		for _, c := range state.Containers {
+			state.Names = append(state.Names, c+"."+base)
+		}
+	}
+	return state, nil
+}
+
+// run runs a command on the remote host
+func run(h Host, args ...string) (string, error) {
+	out, _, err := util.RunOn(util.Options{}, h.SSH, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(out, "\r", "", -1), nil
+}
+
+// containerNames turns `docker ps` names into DNS labels - swarm task names (stack_web.1.xyz) just keep
+// the first part, and underscores (not allowed in host names) become dashes: stack-web
+func containerNames(out string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		name := strings.ToLower(strings.TrimSpace(line))
+		name = strings.SplitN(name, ".", 2)[0]
+		name = strings.Replace(name, "_", "-", -1)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hostAddress is the configured address, or what the ssh destination resolves to
+func hostAddress(h Host) (string, error) {
+	if h.Address != "" {
+		return h.Address, nil
+	}
+	return util.ResolveSSHHost(h.SSH)
+}
@@ -0,0 +1,215 @@
+package remote
+
+// tunnels are ssh local port forwards, from a loopback address here to ports on a remote host,
+// for when the remote's ports aren't reachable directly (firewalls, or only published on its localhost).
+// Each tunnel gets its own loopback address, its name is published pointing at that address,
+// and the ssh process is restarted (with backoff) whenever it dies.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// PortForward is a local port, and the port it goes to on the remote end
+type PortForward struct {
+	Local  int
+	Remote int
+}
+
+// Tunnel is a [tunnel "name"] section from the cfg file
+type Tunnel struct {
+	Name string
+	SSH  string
+	Zone string
+	// the loopback address to listen on
+	Address string
+	// where the ports are, as seen from the remote host
+	To    string
+	Ports []PortForward
+}
+
+// TunnelState is how a tunnel's ssh process is doing
+type TunnelState struct {
+	Name     string
+	SSH      string
+	Address  string
+	Ports    []string
+	State    string
+	Since    time.Time
+	Restarts int
+	Error    string `json:",omitempty"`
+}
+
+var tunnelStates = map[string]*TunnelState{}
+
+// the longest we wait between restarts of a failing tunnel
+const maxTunnelBackoff = time.Minute
+
+// TunnelAddress is the loopback address the index'th tunnel gets, unless it sets its own
+func TunnelAddress(index int) string {
+	return fmt.Sprintf("127.0.1.%d", index+1)
+}
+
+// ParsePorts reads a list of ports like "5432, 8080:80" (LOCAL:REMOTE, or the same port on both ends)
+func ParsePorts(list string) ([]PortForward, error) {
+	ports := []PortForward{}
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		parts := strings.SplitN(p, ":", 2)
+		local, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q", p)
+		}
+		remote := local
+		if len(parts) > 1 {
+			if remote, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, fmt.Errorf("bad port %q", p)
+			}
+		}
+		ports = append(ports, PortForward{Local: local, Remote: remote})
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports")
+	}
+	return ports, nil
+}
+
+// Tunnels returns how each tunnel is doing, sorted by name
+func Tunnels() []TunnelState {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	list := []TunnelState{}
+	for _, s := range tunnelStates {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func startTunnel(t Tunnel) {
+	state := &TunnelState{Name: t.Name, SSH: t.SSH, Address: t.Address, State: "starting", Since: time.Now()}
+	for _, p := range t.Ports {
+		state.Ports = append(state.Ports, fmt.Sprintf("%d->%s:%d", p.Local, t.To, p.Remote))
+	}
+	stateLock.Lock()
+	tunnelStates[t.Name] = state
+	stateLock.Unlock()
+
+	if err := publishNames("tunnel "+t.Name, t.Zone, []string{t.Name}, t.Address); err != nil {
+		logger.Errorf("tunnel %s: %s\n", t.Name, err)
+	}
+	go superviseTunnel(t)
+}
+
+func setTunnelState(name, state string, err error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	s := tunnelStates[name]
+	if s.State != state {
+		s.State = state
+		s.Since = time.Now()
+	}
+	if state == "restarting" {
+		s.Restarts++
+	}
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// superviseTunnel keeps the tunnel's ssh running, waiting longer between restarts while it keeps failing
+func superviseTunnel(t Tunnel) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := runTunnel(t)
+		if time.Since(started) > maxTunnelBackoff {
+			// it was up for a good while, so this is a new problem
+			backoff = time.Second
+		}
+		logger.Warningf("tunnel %s stopped (%s), restarting in %s\n", t.Name, err, backoff)
+		setTunnelState(t.Name, "restarting", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxTunnelBackoff {
+			backoff = maxTunnelBackoff
+		}
+	}
+}
+
+// runTunnel runs the ssh forward until it exits, marking the tunnel up once its first port answers
+func runTunnel(t Tunnel) error {
+	if err := ensureLoopbackAlias(t.Address); err != nil {
+		return err
+	}
+	args := []string{"-4", "-N",
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveCountMax=3",
+		// become the shared connection RunOn uses - or, if there already is one, just connect separately
+		"-o", util.SSHControlPath,
+		"-o", "ControlMaster=yes",
+		"-o", "ControlPersist=no",
+	}
+	for _, p := range t.Ports {
+		args = append(args, "-L", fmt.Sprintf("%s:%d:%s:%d", t.Address, p.Local, t.To, p.Remote))
+	}
+	args = append(args, t.SSH)
+
+	cmd := exec.Command("ssh", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	logger.Infof("tunnel %s: ssh %s\n", t.Name, strings.Join(args, " "))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	probe := net.JoinHostPort(t.Address, strconv.Itoa(t.Ports[0].Local))
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	up := false
+	for {
+		select {
+		case err := <-done:
+			if msg := lastLine(stderr.String()); msg != "" {
+				return fmt.Errorf("%s: %s", err, msg)
+			}
+			if err == nil {
+				err = fmt.Errorf("ssh exited")
+			}
+			return err
+		case <-ticker.C:
+			if up {
+				continue
+			}
+			if conn, err := net.DialTimeout("tcp", probe, time.Second); err == nil {
+				conn.Close()
+				up = true
+				logger.Infof("tunnel %s is up on %s\n", t.Name, t.Address)
+				setTunnelState(t.Name, "up", nil)
+			}
+		}
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,333 @@
+package remote
+
+// volumes keep a local directory pushed to a path on a remote host, so bind mounts on the remote
+// docker see the files you're editing here. A polling watcher notices what changed, and only those
+// files are rsync'd over the shared ssh connection. Polling walks the whole tree every interval, which
+// costs some cpu on big trees, but needs no dependency, no watch per directory (inotify limits, or a
+// file handle per file with kqueue on macOS), and works the same on every platform. Files that were also changed on the remote since
+// the last sync are conflicts: they aren't pushed, and stay listed until you save them again here
+// (which pushes your version).
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onaci/cirrid/util"
+)
+
+// Volume is a [volume "name"] section from the cfg file
+type Volume struct {
+	Name  string
+	SSH   string
+	Local string
+	// the path on the remote host
+	Path     string
+	Exclude  []string
+	Interval time.Duration
+}
+
+// VolumeState is how a volume's syncing is going
+type VolumeState struct {
+	Name      string
+	SSH       string
+	Local     string
+	Path      string
+	State     string
+	LastSync  time.Time
+	Pushed    int
+	Conflicts []string
+	Error     string `json:",omitempty"`
+}
+
+const DefaultVolumeInterval = 2 * time.Second
+
+var volumeLock sync.Mutex
+var runningVolumes = map[string]runningVolume{}
+var volumeStates = map[string]*VolumeState{}
+
+type runningVolume struct {
+	volume Volume
+	stop   chan struct{}
+}
+
+// SyncVolumes starts syncing the volumes that are new (or changed), and stops the ones that are gone
+func SyncVolumes(volumes []Volume) {
+	volumeLock.Lock()
+	defer volumeLock.Unlock()
+	wanted := map[string]Volume{}
+	for _, v := range volumes {
+		if v.Interval <= 0 {
+			v.Interval = DefaultVolumeInterval
+		}
+		wanted[v.Name] = v
+	}
+	for name, r := range runningVolumes {
+		if v, ok := wanted[name]; ok && reflect.DeepEqual(v, r.volume) {
+			continue
+		}
+		logger.Infof("volume %s: stopping\n", name)
+		close(r.stop)
+		delete(runningVolumes, name)
+		stateLock.Lock()
+		delete(volumeStates, name)
+		stateLock.Unlock()
+	}
+	for name, v := range wanted {
+		if _, ok := runningVolumes[name]; ok {
+			continue
+		}
+		r := runningVolume{volume: v, stop: make(chan struct{})}
+		runningVolumes[name] = r
+		stateLock.Lock()
+		volumeStates[name] = &VolumeState{Name: v.Name, SSH: v.SSH, Local: v.Local, Path: v.Path, State: "starting"}
+		stateLock.Unlock()
+		go watchVolume(v, r.stop)
+	}
+}
+
+// Volumes returns how each volume is doing, sorted by name
+func Volumes() []VolumeState {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	list := []VolumeState{}
+	for _, s := range volumeStates {
+		v := *s
+		v.Conflicts = append([]string{}, s.Conflicts...)
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func updateVolumeState(name string, update func(s *VolumeState)) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if s, ok := volumeStates[name]; ok {
+		update(s)
+	}
+}
+
+func watchVolume(v Volume, stop chan struct{}) {
+	var files map[string]fileInfo
+	// the remote's clock at the last sync, so we can ask it what changed since
+	var lastSync int64
+	conflicts := map[string]bool{}
+
+	for {
+		current, err := snapshot(v)
+		if err == nil {
+			if files == nil {
+				lastSync, err = fullSync(v)
+			} else if changed := changedFiles(files, current); len(changed) > 0 {
+				err = pushChanges(v, changed, &lastSync, conflicts)
+			}
+		}
+		if err != nil {
+			logger.Warningf("volume %s: %s\n", v.Name, err)
+			updateVolumeState(v.Name, func(s *VolumeState) {
+				s.State = "failed"
+				s.Error = err.Error()
+			})
+		} else {
+			// only move on once its pushed, so failed changes are tried again
+			files = current
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(v.Interval):
+		}
+	}
+}
+
+type fileInfo struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshot lists the files under the volume's local dir (that aren't excluded), relative to it
+func snapshot(v Volume) (map[string]fileInfo, error) {
+	files := map[string]fileInfo{}
+	err := filepath.Walk(v.Local, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(v.Local, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if excluded(v, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0 {
+			files[filepath.ToSlash(rel)] = fileInfo{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// excluded is true if any part of the path matches one of the volume's exclude patterns
+func excluded(v Volume, rel string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		for _, pattern := range v.Exclude {
+			if ok, _ := filepath.Match(pattern, part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changedFiles lists the files that are new, changed or removed
+func changedFiles(before, after map[string]fileInfo) []string {
+	changed := []string{}
+	for name, info := range after {
+		if old, ok := before[name]; !ok || old != info {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// fullSync pushes the whole dir, without overwriting anything thats newer on the remote
+func fullSync(v Volume) (int64, error) {
+	now, err := remoteNow(v)
+	if err != nil {
+		return 0, err
+	}
+	updateVolumeState(v.Name, func(s *VolumeState) { s.State = "syncing" })
+	args := []string{"-az", "--update"}
+	for _, pattern := range v.Exclude {
+		args = append(args, "--exclude="+pattern)
+	}
+	if err := rsync(v, fullSyncTimeout, args...); err != nil {
+		return 0, err
+	}
+	logger.Infof("volume %s: synced %s to %s:%s\n", v.Name, v.Local, v.SSH, v.Path)
+	updateVolumeState(v.Name, func(s *VolumeState) {
+		s.State = "in sync"
+		s.LastSync = time.Now()
+		s.Error = ""
+	})
+	return now, nil
+}
+
+// pushChanges pushes the changed files, except the ones that also changed on the remote since the last sync
+func pushChanges(v Volume, changed []string, lastSync *int64, conflicts map[string]bool) error {
+	now, remoteChanged, err := remoteChangesSince(v, *lastSync)
+	if err != nil {
+		return err
+	}
+	push := []string{}
+	for _, name := range changed {
+		if remoteChanged[name] {
+			if !conflicts[name] {
+				logger.Warningf("volume %s: %s changed here and on %s, not pushing it\n", v.Name, name, v.SSH)
+			}
+			conflicts[name] = true
+			continue
+		}
+		// saving it again here (after the remote change) means you want your version
+		delete(conflicts, name)
+		push = append(push, name)
+	}
+
+	if len(push) > 0 {
+		updateVolumeState(v.Name, func(s *VolumeState) { s.State = "syncing" })
+		list, err := ioutil.TempFile("", "cirrid-volume-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(list.Name())
+		_, err = list.WriteString(strings.Join(push, "\n") + "\n")
+		list.Close()
+		if err != nil {
+			return err
+		}
+		// removed files are missing here, so --delete-missing-args removes them there too
+		if err := rsync(v, pushTimeout, "-az", "--files-from="+list.Name(), "--delete-missing-args"); err != nil {
+			return err
+		}
+		logger.Infof("volume %s: pushed %d files\n", v.Name, len(push))
+	}
+	*lastSync = now
+
+	names := []string{}
+	for name := range conflicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	updateVolumeState(v.Name, func(s *VolumeState) {
+		s.State = "in sync"
+		if len(names) > 0 {
+			s.State = "conflicts"
+		}
+		s.LastSync = time.Now()
+		s.Pushed = len(push)
+		s.Conflicts = names
+		s.Error = ""
+	})
+	return nil
+}
+
+// rsync runs rsync from the local dir to the remote path, over the shared ssh connection
+func rsync(v Volume, timeout time.Duration, args ...string) error {
+	cmdline := append([]string{"rsync", "-e", strings.Join(util.SSHCommand(), " ")}, args...)
+	cmdline = append(cmdline, strings.TrimSuffix(v.Local, "/")+"/", v.SSH+":"+strings.TrimSuffix(v.Path, "/")+"/")
+	_, _, err := util.RunLocally(util.Options{Timeout: timeout}, cmdline...)
+	return err
+}
+
+// the first sync can be big, after that its a few files at a time
+const fullSyncTimeout = time.Hour
+const pushTimeout = 5 * time.Minute
+
+// remoteNow is the remote's clock (making sure the path exists while we're there)
+func remoteNow(v Volume) (int64, error) {
+	out, err := run(Host{SSH: v.SSH}, "sh", "-c", `mkdir -p "$1" && date +%s`, "sh", v.Path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// remoteChangesSince asks the remote for its clock, and the files under the path changed since the time given
+func remoteChangesSince(v Volume, since int64) (int64, map[string]bool, error) {
+	path := strings.TrimSuffix(v.Path, "/")
+	// the path goes in as $1, so whatever's in it can't change the script
+	out, err := run(Host{SSH: v.SSH}, "sh", "-c", `date +%s; find "$1" -newermt "@$2" ! -type d`, "sh", path, strconv.FormatInt(since, 10))
+	if err != nil {
+		return 0, nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	now, err := strconv.ParseInt(strings.TrimSpace(lines[0]), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("can't read the remote's clock: %q", lines[0])
+	}
+	changed := map[string]bool{}
+	for _, line := range lines[1:] {
+		if rel := strings.TrimPrefix(strings.TrimSpace(line), path+"/"); rel != "" {
+			changed[rel] = true
+		}
+	}
+	return now, changed, nil
+}
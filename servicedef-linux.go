@@ -0,0 +1,85 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kardianos/service"
+)
+
+// the systemd unit settings we set through svcConfig.Option
+var systemdRestartKeys = []string{"Restart", "SuccessExitStatus"}
+
+func wantedServiceDefinition(svcConfig *service.Config) serviceDefinition {
+	d := serviceDefinition{
+		Executable:   svcConfig.Executable,
+		Arguments:    svcConfig.Arguments,
+		Dependencies: svcConfig.Dependencies,
+		Restart:      map[string]string{},
+	}
+	for _, key := range systemdRestartKeys {
+		if v, ok := svcConfig.Option[key]; ok {
+			d.Restart[key] = fmt.Sprint(v)
+		}
+	}
+	return d
+}
+
+func installedServiceDefinition(svcConfig *service.Config) (serviceDefinition, string, bool, error) {
+	d := serviceDefinition{Restart: map[string]string{}}
+	if service.Platform() != "linux-systemd" {
+		// TODO: sysv, upstart and openrc
+		return d, "", false, fmt.Errorf("can't compare %s services", service.Platform())
+	}
+	path := "/etc/systemd/system/" + svcConfig.Name + ".service"
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, path, false, nil
+		}
+		return d, path, false, err
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch {
+		case section == "[Unit]" && key != "Description" && key != "ConditionFileIsExecutable":
+			d.Dependencies = append(d.Dependencies, line)
+		case section == "[Service]" && key == "ExecStart":
+			fields := strings.Fields(value)
+			for i := range fields {
+				fields[i] = strings.Trim(fields[i], `"`)
+			}
+			if len(fields) > 0 {
+				d.Executable = fields[0]
+				d.Arguments = fields[1:]
+			}
+		case section == "[Service]":
+			for _, k := range systemdRestartKeys {
+				if key == k {
+					d.Restart[key] = value
+				}
+			}
+		}
+	}
+	return d, path, true, scanner.Err()
+}
@@ -0,0 +1,75 @@
+// +build darwin
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kardianos/service"
+)
+
+func launchdBool(svcConfig *service.Config, key string, def bool) string {
+	if v, ok := svcConfig.Option[key].(bool); ok {
+		return fmt.Sprint(v)
+	}
+	return fmt.Sprint(def)
+}
+
+func wantedServiceDefinition(svcConfig *service.Config) serviceDefinition {
+	// launchd doesn't do dependencies
+	return serviceDefinition{
+		Executable: svcConfig.Executable,
+		Arguments:  svcConfig.Arguments,
+		Restart: map[string]string{
+			"KeepAlive": launchdBool(svcConfig, "KeepAlive", true),
+			"RunAtLoad": launchdBool(svcConfig, "RunAtLoad", false),
+		},
+	}
+}
+
+// plistDict is the top level <dict> of a plist, as alternating <key> and value elements
+type plistDict struct {
+	Items []struct {
+		XMLName xml.Name
+		Value   string   `xml:",chardata"`
+		Strings []string `xml:"string"`
+	} `xml:",any"`
+}
+
+func installedServiceDefinition(svcConfig *service.Config) (serviceDefinition, string, bool, error) {
+	d := serviceDefinition{Restart: map[string]string{}}
+	path := "/Library/LaunchDaemons/" + svcConfig.Name + ".plist"
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, path, false, nil
+		}
+		return d, path, false, err
+	}
+	var plist struct {
+		Dict plistDict `xml:"dict"`
+	}
+	if err := xml.Unmarshal(contents, &plist); err != nil {
+		return d, path, false, err
+	}
+	items := plist.Dict.Items
+	for i := 0; i+1 < len(items); i++ {
+		if items[i].XMLName.Local != "key" {
+			continue
+		}
+		value := items[i+1]
+		switch items[i].Value {
+		case "ProgramArguments":
+			if len(value.Strings) > 0 {
+				d.Executable = value.Strings[0]
+				d.Arguments = value.Strings[1:]
+			}
+		case "KeepAlive", "RunAtLoad":
+			d.Restart[items[i].Value] = value.XMLName.Local
+		}
+	}
+	return d, path, true, nil
+}
@@ -0,0 +1,43 @@
+// +build windows
+
+package main
+
+import (
+	"strings"
+
+	"github.com/kardianos/service"
+	"github.com/onaci/cirrid/util"
+)
+
+func wantedServiceDefinition(svcConfig *service.Config) serviceDefinition {
+	return serviceDefinition{
+		Executable: svcConfig.Executable,
+		Arguments:  svcConfig.Arguments,
+	}
+}
+
+func installedServiceDefinition(svcConfig *service.Config) (serviceDefinition, string, bool, error) {
+	d := serviceDefinition{}
+	out, _, err := util.RunLocally(util.Options{}, "sc", "qc", svcConfig.Name)
+	if util.ExitCode(err) == 1060 || strings.Contains(out, "1060") {
+		// ERROR_SERVICE_DOES_NOT_EXIST
+		return d, svcConfig.Name, false, nil
+	}
+	if err != nil {
+		return d, svcConfig.Name, false, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "BINARY_PATH_NAME" {
+			fields := strings.Fields(strings.TrimSpace(parts[1]))
+			for i := range fields {
+				fields[i] = strings.Trim(fields[i], `"`)
+			}
+			if len(fields) > 0 {
+				d.Executable = fields[0]
+				d.Arguments = fields[1:]
+			}
+		}
+	}
+	return d, svcConfig.Name, true, nil
+}
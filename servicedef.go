@@ -0,0 +1,73 @@
+package main
+
+// compare the installed service definition (systemd unit, launchd plist...) with the one we'd install,
+// so `cirrid install` only reinstalls the service when something's changed
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/kardianos/service"
+)
+
+// serviceDefinition is the part of a service definition we care about
+type serviceDefinition struct {
+	Executable   string
+	Arguments    []string
+	Dependencies []string
+	// the service manager's restart settings, eg Restart, SuccessExitStatus or KeepAlive
+	Restart map[string]string
+}
+
+func (d serviceDefinition) diff(installed serviceDefinition) []string {
+	diffs := []string{}
+	if d.Executable != installed.Executable {
+		diffs = append(diffs, fmt.Sprintf("executable: %s -> %s", installed.Executable, d.Executable))
+	}
+	if strings.Join(d.Arguments, " ") != strings.Join(installed.Arguments, " ") {
+		diffs = append(diffs, fmt.Sprintf("arguments: %q -> %q", installed.Arguments, d.Arguments))
+	}
+	if strings.Join(d.Dependencies, "\n") != strings.Join(installed.Dependencies, "\n") {
+		diffs = append(diffs, fmt.Sprintf("dependencies: %q -> %q", installed.Dependencies, d.Dependencies))
+	}
+	for key, value := range d.Restart {
+		if installed.Restart[key] != value {
+			diffs = append(diffs, fmt.Sprintf("%s: %q -> %q", key, installed.Restart[key], value))
+		}
+	}
+	return diffs
+}
+
+// ensureService installs the service, or reinstalls it if its definition has changed
+func ensureService(s service.Service, svcConfig *service.Config) error {
+	installed, path, found, err := installedServiceDefinition(svcConfig)
+	if err != nil {
+		log.Printf("Can't read the installed service definition, leaving it alone: %s\n", err)
+		return nil
+	}
+	if !found {
+		log.Printf("Installing service:\n")
+		return service.Control(s, "install")
+	}
+
+	diffs := wantedServiceDefinition(svcConfig).diff(installed)
+	if len(diffs) == 0 {
+		log.Printf("OK: service definition %s is up to date\n", path)
+		return nil
+	}
+	log.Printf("Service definition %s is out of date:\n", path)
+	for _, d := range diffs {
+		log.Printf("  %s\n", d)
+	}
+	if status, err := s.Status(); err == nil && status == service.StatusRunning {
+		if err := service.Control(s, "stop"); err != nil {
+			return err
+		}
+	}
+	if err := service.Control(s, "uninstall"); err != nil {
+		return err
+	}
+	log.Printf("Reinstalling service:\n")
+	return service.Control(s, "install")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/onaci/cirrid/acme"
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/install"
+	"github.com/onaci/cirrid/proxy"
+	"github.com/onaci/cirrid/remote"
+	"github.com/onaci/cirrid/util"
+)
+
+// daemonStatus is what the running daemon reports to `cirrid status`
+type daemonStatus struct {
+	Version        string
+	Platform       string
+	Zones          []dns.Zone
+	DNSAddress     string
+	RoutingDomains []string
+	Magic          dns.MagicStatus
+	Records        []string
+	Update         install.UpdateStatus
+	Remotes        []remote.State
+	Tunnels        []remote.TunnelState
+	Volumes        []remote.VolumeState
+	DockerContext  string
+	DockerHost     string
+	Proxy          []proxy.Route
+	CA             ca.Info
+	ACME           string
+	SecureDNS      []string
+	Upstream       []string
+	Cache          dns.CacheStats
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`cirrid {{.Version}} ({{.Platform}})
+{{- with .Update}}
+{{- if .Available}}
+update available: {{.Latest}} (checked {{.Checked.Format "2006-01-02 15:04"}}), use 'sudo cirrid upgrade'
+{{- else if .Error}}
+update check failed: {{.Error}}
+{{- else if not .Checked.IsZero}}
+up to date (checked {{.Checked.Format "2006-01-02 15:04"}})
+{{- end}}
+{{- end}}
+zones:
+{{- range .Zones}}
+  {{.Name}} (ttl {{.TTL}}{{if .Wildcard}}, wildcards{{end}}{{if .Forward}}, forward to {{join .Forward ", "}}{{end}})
+{{- end}}
+{{- if .Upstream}}
+other names are asked of {{join .Upstream ", "}}
+{{- end}}
+{{- with .Cache}}{{if .Size}}
+cache: {{.Entries}} of {{.Size}} answers ({{.Hits}} hits, {{.Misses}} misses)
+{{- end}}{{end}}
+{{- range .SecureDNS}}
+also listening on {{.}}
+{{- end}}
+
+{{- if .DockerHost}}
+docker context: {{.DockerContext}} ({{.DockerHost}})
+{{- end}}
+magic IP: {{.Magic.Address}} (strategy {{.Magic.Strategy}}: {{.Magic.Reason}})
+{{- range .Magic.Attempts}}
+  {{printf "%-16s" .Strategy}} {{if .Address}}{{.Address}} {{end}}{{.Result}}
+{{- end}}
+
+{{- if .Remotes}}
+
+remote hosts:
+{{- range .Remotes}}
+  {{.Name}} ({{.SSH}}){{if .Address}} at {{.Address}}{{end}}{{if .Stackdomain}}, stackdomain {{.Stackdomain}}{{end}}
+  {{- if not .Refreshed.IsZero}}, refreshed {{.Refreshed.Format "15:04:05"}}{{end}}
+  {{- if .Error}}
+    error: {{.Error}}
+  {{- end}}
+  {{- if .Names}}
+    names: {{join .Names ", "}}
+  {{- end}}
+{{- end}}
+{{- end}}
+{{- if .Tunnels}}
+
+tunnels:
+{{- range .Tunnels}}
+  {{.Name}} on {{.Address}} via {{.SSH}}: {{.State}} since {{.Since.Format "15:04:05"}}{{if .Restarts}} ({{.Restarts}} restarts){{end}}
+    {{join .Ports ", "}}
+  {{- if .Error}}
+    error: {{.Error}}
+  {{- end}}
+{{- end}}
+{{- end}}
+{{- if .Volumes}}
+
+volumes:
+{{- range .Volumes}}
+  {{template "volume" .}}
+{{- end}}
+{{- end}}
+{{- if .Proxy}}
+
+proxy routes:
+{{- range .Proxy}}
+  {{printf "%-30s" .Host}} {{.Target}} ({{.Source}})
+{{- end}}
+{{- end}}
+{{- with .CA}}{{if .Subject}}
+
+local CA: {{.Subject}} ({{if .Trusted}}trusted{{else}}not trusted, use 'sudo cirrid ca trust'{{end}})
+{{- range .Certs}}
+  {{join .Names ", "}}: {{.CertFile}} (expires {{.NotAfter.Format "2006-01-02 15:04"}})
+{{- end}}
+{{- end}}{{end}}
+{{- if .ACME}}
+ACME directory: {{.ACME}}
+{{- end}}
+
+records:
+{{- range .Records}}
+  {{.}}
+{{- end}}
+`))
+
+// a volume's one line summary, for status and `cirrid volumes ls`
+var volumeTemplate = template.Must(statusTemplate.New("volume").Parse(
+	`{{.Name}}: {{.Local}} -> {{.SSH}}:{{.Path}} {{.State}}{{if not .LastSync.IsZero}} (last sync {{.LastSync.Format "15:04:05"}}){{end}}
+  {{- if .Error}}
+    error: {{.Error}}
+  {{- end}}
+  {{- range .Conflicts}}
+    conflict: {{.}}
+  {{- end}}`))
+
+func getStatus() daemonStatus {
+	return daemonStatus{
+		Version:        install.Version,
+		Platform:       runtime.GOOS + "/" + runtime.GOARCH,
+		Zones:          dns.Zones(),
+		DNSAddress:     dns.ServerAddress(),
+		RoutingDomains: dns.RoutingDomains(),
+		Magic:          dns.GetMagic(),
+		Records:        dns.Records(),
+		Update:         getUpdateStatus(),
+		Remotes:        remote.Status(),
+		Tunnels:        remote.Tunnels(),
+		Volumes:        remote.Volumes(),
+		DockerContext:  getDockerContext().Name,
+		DockerHost:     util.DockerHost(),
+		Proxy:          proxy.Routes(),
+		CA:             ca.GetInfo(),
+		ACME:           acme.DirectoryURL(),
+		SecureDNS:      dns.SecureEndpoints(),
+		Upstream:       dns.Upstream(),
+		Cache:          dns.GetCacheStats(),
+	}
+}
+
+func registerStatusHandler() {
+	control.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, getStatus())
+	})
+}
+
+// `cirrid status` - ask the running daemon what it's doing
+func statusCmd(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output the raw status json")
+	flags.Parse(args)
+
+	var status daemonStatus
+	if err := control.Get("/status", &status); err != nil {
+		return err
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	return statusTemplate.Execute(os.Stdout, status)
+}
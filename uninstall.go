@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/onaci/cirrid/acme"
+	"github.com/onaci/cirrid/ca"
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/dns"
+	"github.com/onaci/cirrid/install"
+
+	"github.com/kardianos/service"
+)
+
+// `cirrid uninstall` - remove the service, the resolver settings, the local CA, and the binaries
+func uninstallCmd(s service.Service, args []string) error {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	keepConfig := flags.Bool("keep-config", false, "don't remove "+globalCfgFile+" (or the local CA)")
+	flags.Parse(args)
+
+	summary := []string{}
+	failed := false
+	note := func(what string, err error) {
+		if err != nil {
+			log.Printf("ERROR: %s: %s\n", what, err)
+			failed = true
+		}
+	}
+
+	if status, err := s.Status(); err == service.ErrNotInstalled {
+		log.Printf("The cirrid service isn't installed\n")
+	} else {
+		if status == service.StatusRunning {
+			note("stopping service", service.Control(s, "stop"))
+		}
+		err := service.Control(s, "uninstall")
+		note("removing service", err)
+		if err == nil {
+			summary = append(summary, "service cirrid")
+		}
+	}
+
+	cfg, cfgErr := loadCfgFile()
+	dns.SetLogger(logger)
+	if cfgErr == nil {
+		// so the resolver settings for names in them (which the daemon published) are known to be ours
+		for _, zone := range caZones(cfg) {
+			dns.AddZone(dns.Zone{Name: zone})
+		}
+	}
+	removed, err := dns.RevertResolveConfigured(logger)
+	note("reverting resolver settings", err)
+	summary = append(summary, removed...)
+
+	if path, err := control.RemoveSocket(); path != "" {
+		summary = append(summary, path)
+	} else {
+		note("removing control socket", err)
+	}
+
+	acmeDir := acme.DefaultDir
+	if cfgErr == nil {
+		ca.Configure(readCA(cfg), logger)
+		acmeCfg, _ := readACME(cfg)
+		acmeDir = acmeCfg.Dir
+	}
+	if ca.Exists() {
+		note("removing the local CA from the trust store", ca.Untrust())
+		if !*keepConfig {
+			removed, err := ca.Remove()
+			note("removing the local CA", err)
+			summary = append(summary, removed...)
+		}
+	}
+	if _, err := os.Stat(acmeDir); err == nil && !*keepConfig {
+		note("removing the ACME accounts", os.RemoveAll(acmeDir))
+		summary = append(summary, acmeDir)
+	}
+
+	removed, err = install.Uninstall()
+	note("removing binaries", err)
+	summary = append(summary, removed...)
+
+	if !*keepConfig {
+		err := os.Remove(globalCfgFile)
+		if err == nil {
+			summary = append(summary, globalCfgFile)
+		} else if !os.IsNotExist(err) {
+			note("removing "+globalCfgFile, err)
+		}
+	}
+
+	fmt.Printf("Removed:\n")
+	for _, what := range summary {
+		fmt.Printf("  %s\n", what)
+	}
+	if *keepConfig {
+		fmt.Printf("Kept %s\n", globalCfgFile)
+		if ca.Exists() {
+			fmt.Printf("Kept the local CA in %s (no longer trusted)\n", filepath.Dir(ca.RootFile()))
+		}
+	}
+	if failed {
+		return fmt.Errorf("uninstall didn't finish cleanly, see the errors above")
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+// the daemon's regular check for newer releases, which can also install them in a maintenance window
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/install"
+
+	"gopkg.in/ini.v1"
+)
+
+type updateSchedule struct {
+	check     bool
+	interval  time.Duration
+	autoApply bool
+	// maintenance window, as minutes after local midnight. start == end means any time.
+	windowStart int
+	windowEnd   int
+}
+
+var updateLock sync.Mutex
+var lastUpdateCheck install.UpdateStatus
+
+func getUpdateStatus() install.UpdateStatus {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	return lastUpdateCheck
+}
+
+// parseWindow reads "HH:MM-HH:MM"
+func parseWindow(window string) (start, end int, err error) {
+	if window == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("maintenance window %q should look like 02:00-04:00", window)
+	}
+	times := []int{}
+	for _, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("maintenance window %q: %s", window, err)
+		}
+		times = append(times, t.Hour()*60+t.Minute())
+	}
+	return times[0], times[1], nil
+}
+
+func readUpdateSchedule(cfg *ini.File) updateSchedule {
+	sec := cfg.Section("update")
+	schedule := updateSchedule{
+		check:     sec.Key("check").MustBool(true),
+		interval:  sec.Key("interval").MustDuration(6 * time.Hour),
+		autoApply: sec.Key("auto_apply").MustBool(false),
+	}
+	start, end, err := parseWindow(sec.Key("window").String())
+	if err != nil {
+		logger.Errorf("Not auto applying updates: %s\n", err)
+		schedule.autoApply = false
+	}
+	schedule.windowStart, schedule.windowEnd = start, end
+	return schedule
+}
+
+func (s updateSchedule) inWindow(t time.Time) bool {
+	if s.windowStart == s.windowEnd {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if s.windowStart < s.windowEnd {
+		return minute >= s.windowStart && minute < s.windowEnd
+	}
+	// the window goes past midnight
+	return minute >= s.windowStart || minute < s.windowEnd
+}
+
+func recordUpdateCheck(status install.UpdateStatus) {
+	updateLock.Lock()
+	lastUpdateCheck = status
+	updateLock.Unlock()
+
+	control.SetGauge("cirrid_update_last_check_timestamp_seconds", "When cirrid last checked for a new release.", float64(status.Checked.Unix()))
+	available := 0.0
+	if status.Available {
+		available = 1
+	}
+	control.ResetGauge("cirrid_update_available")
+	control.SetGauge("cirrid_update_available", "1 if there's a newer cirrid release.", available, "current", status.Current, "latest", status.Latest)
+	errored := 0.0
+	if status.Error != "" {
+		errored = 1
+	}
+	control.SetGauge("cirrid_update_check_failed", "1 if the last check for a new release failed.", errored)
+
+	if status.Error != "" {
+		logger.Warningf("Update check failed: %s\n", status.Error)
+	} else if status.Available {
+		logger.Warningf("cirrid %s is available (running %s), use `sudo cirrid upgrade`\n", status.Latest, status.Current)
+	} else {
+		logger.Infof("cirrid %s is up to date\n", status.Current)
+	}
+}
+
+// checkForUpdates runs until exit is closed, checking for a new release every interval,
+// and installing it in the maintenance window if auto_apply is set
+func checkForUpdates(schedule updateSchedule, exit chan struct{}) {
+	control.SetGauge("cirrid_info", "The running cirrid version.", 1, "version", install.Version)
+	if !schedule.check {
+		logger.Infof("Update checks are turned off\n")
+		<-exit
+		return
+	}
+	if install.IsDevelopment(install.Version) {
+		logger.Infof("Not checking for updates, %s isn't a release\n", install.Version)
+		<-exit
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	next := time.Now()
+	for {
+		if now := time.Now(); !now.Before(next) {
+			recordUpdateCheck(install.CheckForUpdate())
+			next = now.Add(schedule.interval)
+		}
+		if status := getUpdateStatus(); status.Available && schedule.autoApply && schedule.inWindow(time.Now()) {
+			applyUpdate()
+		}
+		select {
+		case <-ticker.C:
+		case <-exit:
+			return
+		}
+	}
+}
+
+func applyUpdate() {
+	logger.Infof("Auto applying update\n")
+	upgraded, err := install.Upgrade(false)
+	if err != nil {
+		logger.Errorf("Auto update failed: %s\n", err)
+		abandonUpdate(err.Error())
+		return
+	}
+	if upgraded {
+		// exit status 1 is a 'success' to the service manager, so it restarts us, running the new binary
+		logger.Infof("Installed new version, restarting\n")
+		os.Exit(1)
+	}
+	// eg the release lost its asset for this platform since the check
+	abandonUpdate(fmt.Sprintf("auto apply found nothing newer than %s to install", install.Version))
+}
+
+// abandonUpdate stops applyUpdate being retried (and asking the releases api again) every minute
+// until the next check, recording why
+func abandonUpdate(why string) {
+	status := getUpdateStatus()
+	status.Available = false
+	status.Error = why
+	recordUpdateCheck(status)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/onaci/cirrid/install"
+
+	"github.com/kardianos/service"
+)
+
+// `cirrid upgrade` - install the latest release, and restart the service
+func upgradeCmd(s service.Service, args []string) error {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	force := flags.Bool("force", false, "install the latest release, even if it isn't newer")
+	url := flags.String("url", "", "releases api url (overrides the [update] url setting)")
+	flags.Parse(args)
+
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	configureInstall(cfg)
+	if *url != "" {
+		install.ReleasesURL = *url
+	}
+
+	upgraded, err := install.Upgrade(*force)
+	if err != nil || !upgraded {
+		return err
+	}
+	log.Printf("Restart service:\n")
+	return service.Control(s, "restart")
+}
+
+// `cirrid sign` - for making releases: sign binaries with (or generate) a release signing key
+func signCmd(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := flags.String("key", "cirrid-signing.key", "private key file")
+	keygen := flags.Bool("keygen", false, "generate a new private key, and print its public key")
+	flags.Parse(args)
+
+	if *keygen {
+		public, err := install.GenerateSigningKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("Wrote %s, build with SIGNING_PUBKEY=%s\n", *keyPath, public)
+		return nil
+	}
+	for _, path := range flags.Args() {
+		if err := install.SignFile(*keyPath, path); err != nil {
+			return err
+		}
+		log.Printf("Signed %s\n", path)
+	}
+	return nil
+}
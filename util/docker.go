@@ -0,0 +1,96 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the docker endpoint cirrid's own docker commands go to - empty for the local default
+var dockerHost string
+var dockerLock sync.RWMutex
+
+// SetDockerHost points RunDocker at a docker endpoint (eg ssh://me@beefy, from a docker context), or back at the local one with ""
+func SetDockerHost(host string) {
+	dockerLock.Lock()
+	defer dockerLock.Unlock()
+	dockerHost = host
+}
+
+// DockerHost is the docker endpoint RunDocker uses
+func DockerHost() string {
+	dockerLock.RLock()
+	defer dockerLock.RUnlock()
+	return dockerHost
+}
+
+// DockerTimeout is how long docker commands get, a hung docker shouldn't hold up the daemon
+const DockerTimeout = 15 * time.Second
+
+// RunDocker runs a docker command against the current docker host
+func RunDocker(o Options, args ...string) (output, errout string, err error) {
+	if o.Timeout == 0 {
+		o.Timeout = DockerTimeout
+	}
+	cmdline := []string{"docker"}
+	if host := DockerHost(); host != "" {
+		cmdline = append(cmdline, "-H", host)
+	}
+	return RunLocally(o, append(cmdline, args...)...)
+}
+
+// RemoteDockerHost returns the host name in a tcp:// or ssh:// docker endpoint, or "" for local sockets and pipes
+func RemoteDockerHost(endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "unix", "npipe", "fd":
+		return "", nil
+	case "ssh":
+		// keep the user, so ~/.ssh/config matches the same way docker's ssh does
+		if u.User != nil {
+			return u.User.Username() + "@" + u.Hostname(), nil
+		}
+		return u.Hostname(), nil
+	case "tcp", "http", "https":
+		return u.Hostname(), nil
+	}
+	return "", fmt.Errorf("unknown docker endpoint %q", endpoint)
+}
+
+// ResolveSSHHost works out the IPv4 address of an ssh destination, asking ssh first, so ~/.ssh/config aliases work
+func ResolveSSHHost(destination string) (string, error) {
+	hostname := destination
+	if i := strings.LastIndex(hostname, "@"); i >= 0 {
+		hostname = hostname[i+1:]
+	}
+	if out, _, err := RunLocally(Options{}, "ssh", "-G", destination); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "hostname" {
+				hostname = fields[1]
+			}
+		}
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.To4() != nil {
+		return ip.String(), nil
+	}
+	ips, err := net.LookupIP(hostname)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no IPv4 address", hostname)
+}
@@ -0,0 +1,266 @@
+package util
+
+// everything cirrid shells out to goes through an Executor, so it can have a deadline,
+// its exit status isn't lost, and it can be swapped for a FakeExecutor when testing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-cmd/cmd"
+)
+
+// Executor runs a command, returning its output. err is an *ExitError if it ran but failed,
+// or says why it didn't run (or was stopped, when ctx was done)
+type Executor interface {
+	Run(ctx context.Context, o Options, args []string) (output, errout string, err error)
+}
+
+// ExitError is a command that ran, but exited with a non-zero status
+type ExitError struct {
+	Args     []string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("%s: exit status %d", e.Args[0], e.ExitCode)
+	lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		msg += ": " + last
+	}
+	return msg
+}
+
+// ExitCode is the exit status in err: 0 for nil, and -1 if the command didn't get to exit
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode
+	}
+	return -1
+}
+
+// DefaultTimeout is how long a command gets, unless its Options say otherwise
+const DefaultTimeout = time.Minute
+
+// DefaultMaxOutput is how much of a command's stdout (and stderr) we keep, unless its Options say otherwise
+const DefaultMaxOutput = 1 << 20
+
+// executor runs RunLocally's (and so RunOn's and RunDocker's) commands, guarded by executorLock
+// as the daemon's goroutines run commands while tests swap it
+var executor Executor = CmdExecutor{}
+var executorLock sync.RWMutex
+
+// UseExecutor swaps the executor for e (a FakeExecutor, in tests), returning a func to put the old one back
+func UseExecutor(e Executor) (restore func()) {
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	old := executor
+	executor = e
+	return func() {
+		executorLock.Lock()
+		defer executorLock.Unlock()
+		executor = old
+	}
+}
+
+func currentExecutor() Executor {
+	executorLock.RLock()
+	defer executorLock.RUnlock()
+	return executor
+}
+
+// CmdExecutor runs commands for real, using go-cmd
+type CmdExecutor struct{}
+
+func (CmdExecutor) Run(ctx context.Context, o Options, args []string) (output, errout string, err error) {
+	cmdOptions := cmd.Options{
+		Buffered:  true,
+		Streaming: false,
+	}
+	if o.Follow {
+		cmdOptions.Buffered = false
+		cmdOptions.Streaming = true
+	}
+	envCmd := cmd.NewCmdOptions(cmdOptions, args[0], args[1:]...)
+
+	doneChan := make(chan struct{}) // only used for follow
+	if o.Follow {
+		// Print STDOUT and STDERR lines streaming from Cmd
+		go func() {
+			defer close(doneChan)
+			// Done when both channels have been closed
+			// https://dave.cheney.net/2013/04/30/curious-channels
+			for envCmd.Stdout != nil || envCmd.Stderr != nil {
+				select {
+				case line, open := <-envCmd.Stdout:
+					if !open {
+						envCmd.Stdout = nil
+						continue
+					}
+					log.Println(line)
+				case line, open := <-envCmd.Stderr:
+					if !open {
+						envCmd.Stderr = nil
+						continue
+					}
+					fmt.Fprintln(os.Stderr, line)
+				}
+			}
+		}()
+	} else {
+		close(doneChan)
+	}
+
+	var status cmd.Status
+	statusChan := envCmd.Start()
+	select {
+	case status = <-statusChan:
+	case <-ctx.Done():
+		envCmd.Stop()
+		status = <-statusChan
+		<-doneChan
+		return limitOutput(status.Stdout, o.MaxOutput), limitOutput(status.Stderr, o.MaxOutput), fmt.Errorf("%s: %s", args[0], ctx.Err())
+	}
+	// Wait for goroutine to print everything
+	<-doneChan
+
+	output = limitOutput(status.Stdout, o.MaxOutput)
+	errout = limitOutput(status.Stderr, o.MaxOutput)
+	if status.Error != nil {
+		return output, errout, status.Error
+	}
+	if status.Exit != 0 {
+		return output, errout, &ExitError{Args: args, ExitCode: status.Exit, Stderr: errout}
+	}
+	return output, errout, nil
+}
+
+// limitOutput joins the output lines, keeping at most max bytes of them
+func limitOutput(lines []string, max int) string {
+	if max == 0 {
+		max = DefaultMaxOutput
+	}
+	out := strings.Join(lines, "\n")
+	if max > 0 && len(out) > max {
+		return out[:max] + "\n[output truncated]"
+	}
+	return out
+}
+
+// FakeExecutor is an Executor for tests: it answers the commands it's told to Expect, and records every call.
+// Use it with `defer util.UseExecutor(fake)()`, and check fake.Unmet() at the end.
+type FakeExecutor struct {
+	lock     sync.Mutex
+	expected []*Expectation
+	Calls    [][]string
+}
+
+// Expectation is a command a FakeExecutor expects, and what it answers with
+type Expectation struct {
+	// the command line expected, "*" matches any one argument
+	Args     []string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// eg context.DeadlineExceeded, to act like it hung
+	Err  error
+	used bool
+}
+
+// Expect adds a command the fake will answer (once), succeeding with no output unless told otherwise
+func (f *FakeExecutor) Expect(args ...string) *Expectation {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	e := &Expectation{Args: args}
+	f.expected = append(f.expected, e)
+	return e
+}
+
+// Returns sets the expected command's output
+func (e *Expectation) Returns(stdout string) *Expectation {
+	e.Stdout = stdout
+	return e
+}
+
+// Fails makes the expected command exit with code, and stderr
+func (e *Expectation) Fails(code int, stderr string) *Expectation {
+	e.ExitCode = code
+	e.Stderr = stderr
+	return e
+}
+
+// Errors makes the expected command not run at all
+func (e *Expectation) Errors(err error) *Expectation {
+	e.Err = err
+	return e
+}
+
+func (e *Expectation) matches(args []string) bool {
+	if len(e.Args) != len(args) {
+		return false
+	}
+	for i := range args {
+		if e.Args[i] != "*" && e.Args[i] != args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Run answers with the first unused expectation that matches, or fails the command if there isn't one
+func (f *FakeExecutor) Run(ctx context.Context, o Options, args []string) (output, errout string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.Calls = append(f.Calls, append([]string{}, args...))
+	for _, e := range f.expected {
+		if e.used || !e.matches(args) {
+			continue
+		}
+		e.used = true
+		if e.Err != nil {
+			return "", "", fmt.Errorf("%s: %s", args[0], e.Err)
+		}
+		if e.ExitCode != 0 {
+			return e.Stdout, e.Stderr, &ExitError{Args: args, ExitCode: e.ExitCode, Stderr: e.Stderr}
+		}
+		return e.Stdout, e.Stderr, nil
+	}
+	return "", "", fmt.Errorf("unexpected command: %q", args)
+}
+
+// Unmet lists the expected commands that were never run
+func (f *FakeExecutor) Unmet() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	unmet := []string{}
+	for _, e := range f.expected {
+		if !e.used {
+			unmet = append(unmet, strings.Join(e.Args, " "))
+		}
+	}
+	return unmet
+}
+
+// Called is true if the command was run
+func (f *FakeExecutor) Called(args ...string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, c := range f.Calls {
+		if reflect.DeepEqual(c, args) {
+			return true
+		}
+	}
+	return false
+}
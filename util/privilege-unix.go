@@ -0,0 +1,36 @@
+// +build !windows
+
+package util
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// IsPrivileged is true if we're running as root
+func IsPrivileged() bool {
+	return os.Geteuid() == 0
+}
+
+// Elevate replaces this process with `sudo cirrid args...` (or pkexec, if there's no sudo)
+// it only returns if that couldn't be done
+func Elevate(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for _, tool := range []string{"sudo", "pkexec"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			continue
+		}
+		newArgs := append([]string{tool, exe}, args...)
+		log.Printf("[VERBOSE] Exec: %s\n", strings.Join(newArgs, " "))
+		return syscall.Exec(path, newArgs, os.Environ())
+	}
+	return fmt.Errorf("can't find sudo or pkexec to get root with")
+}
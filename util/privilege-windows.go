@@ -0,0 +1,19 @@
+// +build windows
+
+package util
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// IsPrivileged is true if we're running elevated (as Administrator)
+func IsPrivileged() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// Elevate can't re-run us elevated on windows (without a UAC prompt dance), so it just says how
+func Elevate(args []string) error {
+	return fmt.Errorf("run cirrid from an Administrator command prompt")
+}
@@ -1,17 +1,32 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"strings"
-
-	"github.com/go-cmd/cmd"
+	"time"
 )
 
-// TODO: rewrite using https://github.com/go-cmd/cmd so I can stream too
 type Options struct {
+	// stream the output to our stdout and stderr, instead of returning it
 	Follow bool
+	// how long to let the command run - 0 is DefaultTimeout (or no limit when following), and < 0 no limit
+	Timeout time.Duration
+	// how much output to keep - 0 is DefaultMaxOutput, and < 0 all of it
+	MaxOutput int
+}
+
+// SSHControlPath is where ssh keeps the shared connection to each host, so RunOn and tunnels reuse one connection
+const SSHControlPath = "ControlPath=~/.ssh/master-%r@%h:%p"
+
+// SSHCommand is the ssh cmdline that shares (or starts) the connection to a host, for RunOn and rsync -e
+func SSHCommand() []string {
+	return []string{"ssh",
+		"-4",
+		"-o", SSHControlPath,
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPersist=60"}
 }
 
 // RunOn run a command on a remote host using shelled out ssh
@@ -19,70 +34,41 @@ func RunOn(o Options, hostname string, args ...string) (output, errout string, e
 	// Use execing ssh to use the .ssh/config file
 	// reuse an exiting connection!
 	// time ssh -t -o ControlPath=~/.ssh/master-%r@%h:%p -o ControlMaster=auto -o ControlPersist=60 hostname ls  -alh
-	newArgs := append([]string{"ssh",
-		"-4",
-		"-t",
-		"-o", "ControlPath=~/.ssh/master-%r@%h:%p",
-		"-o", "ControlMaster=auto",
-		"-o", "ControlPersist=60",
-		hostname})
+	newArgs := append(SSHCommand(), "-t", hostname)
 	for _, arg := range args {
-		// Add quotes to enable args with spaces
+		// ssh joins the args into one line for the remote shell, so quote them to keep them as they are
 		// TODO: watch https://github.com/AkihiroSuda/sshocker/issues/10 for more
-		newArgs = append(newArgs, "\""+arg+"\"")
+		newArgs = append(newArgs, ShellQuote(arg))
 	}
 	return RunLocally(o, newArgs...)
 }
 
-// RunLocally run a command on a remote host using shelled out ssh
+// ShellQuote single quotes s for a posix shell, so spaces, quotes and $ in it aren't interpreted
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RunLocally run a command on this host, giving up after the Options' Timeout
 func RunLocally(o Options, args ...string) (output, errout string, err error) {
+	return RunContext(context.Background(), o, args...)
+}
+
+// RunContext runs a command on this host, stopping it when ctx is done (or the Options' Timeout passes).
+// err is an *ExitError if the command failed, which still comes with its output.
+func RunContext(ctx context.Context, o Options, args ...string) (output, errout string, err error) {
 	// log.Printf("[VERBOSE] ENV: %s\n", strings.Join(os.Environ(), " "))
 	log.Printf("[VERBOSE] Exec: %s\n", strings.Join(args, " "))
 
-	doneChan := make(chan struct{}) // only used ror follow
-	cmdOptions := cmd.Options{
-		Buffered:  true,
-		Streaming: false,
+	timeout := o.Timeout
+	if timeout == 0 && !o.Follow {
+		timeout = DefaultTimeout
 	}
-	if o.Follow {
-		cmdOptions.Buffered = false
-		cmdOptions.Streaming = true
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-
-	// Create Cmd with options
-	envCmd := cmd.NewCmdOptions(cmdOptions, args[0], args[1:]...)
-	if !o.Follow {
-		status := <-envCmd.Start()
-
-		return strings.Join(status.Stdout, "\n"), strings.Join(status.Stderr, "\n"), status.Error
-	}
-
-	// Print STDOUT and STDERR lines streaming from Cmd
-	go func() {
-		defer close(doneChan)
-		// Done when both channels have been closed
-		// https://dave.cheney.net/2013/04/30/curious-channels
-		for envCmd.Stdout != nil || envCmd.Stderr != nil {
-			select {
-			case line, open := <-envCmd.Stdout:
-				if !open {
-					envCmd.Stdout = nil
-					continue
-				}
-				log.Println(line)
-			case line, open := <-envCmd.Stderr:
-				if !open {
-					envCmd.Stderr = nil
-					continue
-				}
-				fmt.Fprintln(os.Stderr, line)
-			}
-		}
-	}()
-	<-envCmd.Start()
-	// Wait for goroutine to print everything
-	<-doneChan
-	return "", "", nil
+	return currentExecutor().Run(ctx, o, args)
 }
 
 // TODO: rewrite using cmdline type pointer so we're not re-creating the []string constantly
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/onaci/cirrid/install"
+
+	"github.com/kardianos/service"
+)
+
+// `cirrid version` - what this binary is, which install and upgrade rely on (see install.BinaryVersion)
+func versionCmd(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output the version info as json")
+	format := flags.String("format", "", "go template for the output, eg {{.Version}} (fields: Version, Commit, BuildTime, GoVersion, Platform)")
+	// older installers asked for --show-only=cirri
+	showOnly := flags.String("show-only", "", "output just this field: version (or cirri), commit, buildtime, goversion or platform")
+	flags.Parse(args)
+
+	info := install.Info()
+	switch {
+	case *asJSON:
+		out, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case *showOnly != "":
+		fields := map[string]string{
+			"version":   info.Version,
+			"cirri":     info.Version,
+			"commit":    info.Commit,
+			"buildtime": info.BuildTime,
+			"goversion": info.GoVersion,
+			"platform":  info.Platform,
+		}
+		value, ok := fields[strings.ToLower(*showOnly)]
+		if !ok {
+			return fmt.Errorf("unknown --show-only field %q", *showOnly)
+		}
+		fmt.Println(value)
+	case *format != "":
+		tmpl, err := template.New("version").Parse(*format)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(os.Stdout, info); err != nil {
+			return err
+		}
+		fmt.Println()
+	default:
+		fmt.Printf("%s\n", info.Version)
+	}
+	return nil
+}
+
+// `cirrid versions` - list the installed versions, and optionally prune old ones
+func versionsCmd(args []string) error {
+	flags := flag.NewFlagSet("versions", flag.ExitOnError)
+	prune := flags.Int("prune", 0, "remove all but the newest N versions (the active one is always kept)")
+	flags.Parse(args)
+
+	if *prune > 0 {
+		requirePrivileges("versions --prune")
+		removed, err := install.Prune(*prune)
+		for _, path := range removed {
+			log.Printf("removed %s\n", path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	versions, err := install.ListVersions()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, v := range versions {
+		active := ""
+		if v.Active {
+			active = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", active, v.Version, v.ModTime.Format("2006-01-02 15:04"), v.Path)
+	}
+	return w.Flush()
+}
+
+// `cirrid rollback [version]` - switch to another installed version, and restart the service
+func rollbackCmd(s service.Service, args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	configureInstall(cfg)
+
+	v, err := install.Rollback(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	log.Printf("Now using %s, restart service:\n", v.Version)
+	return service.Control(s, "restart")
+}
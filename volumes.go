@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/onaci/cirrid/control"
+	"github.com/onaci/cirrid/remote"
+)
+
+func registerVolumeHandlers() {
+	control.HandleFunc("/volumes", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, remote.Volumes())
+	})
+	// re-read the [volume] sections, after `cirrid volumes add|rm` changed them
+	control.HandlePrivileged("/volumes/reload", func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := loadCfgFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		remote.SyncVolumes(readVolumes(cfg, readRemotes(cfg)))
+		control.WriteJSON(w, remote.Volumes())
+	})
+}
+
+// `cirrid volumes add|ls|rm` - manage the dirs kept pushed to remote hosts
+func volumesCmd(args []string) error {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	switch args[0] {
+	case "ls":
+		return volumesLs(args[1:])
+	case "add":
+		requirePrivileges("volumes add")
+		return volumesAdd(args[1:])
+	case "rm":
+		requirePrivileges("volumes rm")
+		return volumesRm(args[1:])
+	}
+	return fmt.Errorf("usage: cirrid volumes add|ls|rm")
+}
+
+func volumesLs(args []string) error {
+	flags := flag.NewFlagSet("volumes ls", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output the raw volume status json")
+	flags.Parse(args)
+
+	var volumes []remote.VolumeState
+	if err := control.Get("/volumes", &volumes); err != nil {
+		return err
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(volumes, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	if len(volumes) == 0 {
+		fmt.Printf("no volumes, add one with 'sudo cirrid volumes add --remote NAME VOLUME LOCALDIR'\n")
+	}
+	for _, v := range volumes {
+		if err := volumeTemplate.Execute(os.Stdout, v); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func volumesAdd(args []string) error {
+	flags := flag.NewFlagSet("volumes add", flag.ExitOnError)
+	via := flags.String("remote", "", "the [remote \"NAME\"] to push to")
+	host := flags.String("host", "", "or the ssh destination to push to")
+	path := flags.String("path", "", "the path on the remote host (defaults to the same as the local dir)")
+	exclude := flags.String("exclude", ".git", "comma separated file name patterns not to push")
+	interval := flags.Duration("interval", remote.DefaultVolumeInterval, "how often to look for changes")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: cirrid volumes add [options] NAME LOCALDIR\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 || (*via == "") == (*host == "") {
+		flags.Usage()
+		return fmt.Errorf("need a NAME and LOCALDIR, and one of --remote or --host")
+	}
+	name := flags.Arg(0)
+	local, err := filepath.Abs(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(local); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", local)
+	}
+
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	if *via != "" {
+		if _, err := cfg.GetSection(`remote "` + strings.ToLower(*via) + `"`); err != nil {
+			return fmt.Errorf("there's no [remote \"%s\"] in %s", *via, globalCfgFile)
+		}
+	}
+	sec := cfg.Section(`volume "` + name + `"`)
+	for key, value := range map[string]string{
+		"remote":   *via,
+		"host":     *host,
+		"local":    local,
+		"path":     *path,
+		"exclude":  *exclude,
+		"interval": interval.String(),
+	} {
+		if value == "" {
+			sec.DeleteKey(key)
+			continue
+		}
+		sec.Key(key).SetValue(value)
+	}
+	if err := cfg.SaveTo(globalCfgFile); err != nil {
+		return err
+	}
+	fmt.Printf("added volume %s to %s\n", name, globalCfgFile)
+	return reloadVolumes()
+}
+
+func volumesRm(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: cirrid volumes rm NAME")
+	}
+	cfg, err := loadCfgFile()
+	if err != nil {
+		return err
+	}
+	section := `volume "` + args[0] + `"`
+	if _, err := cfg.GetSection(section); err != nil {
+		return fmt.Errorf("there's no volume %s", args[0])
+	}
+	cfg.DeleteSection(section)
+	if err := cfg.SaveTo(globalCfgFile); err != nil {
+		return err
+	}
+	fmt.Printf("removed volume %s from %s (the files on both ends are left alone)\n", args[0], globalCfgFile)
+	return reloadVolumes()
+}
+
+func reloadVolumes() error {
+	if err := control.Post("/volumes/reload", nil, nil); err != nil {
+		fmt.Printf("the daemon will pick it up when it next starts: %s\n", err)
+	}
+	return nil
+}